@@ -0,0 +1,301 @@
+package main
+
+// JSON API, for scripts:
+//	GET		/api/v1/docs?q=query	search (cf. query.go)
+//	POST	/api/v1/docs			add a document
+//	GET		/api/v1/docs/id			fetch a document
+//	PUT		/api/v1/docs/id			update a document
+//	DELETE	/api/v1/docs/id			move a document to the trash
+//	GET		/api/v1/tags			list one's tags
+//	POST	/api/v1/tags			merge tags: {"From": [...], "To": "..."}
+//	PUT		/api/v1/tags/name		rename a tag: {"Name": "..."}
+//	DELETE	/api/v1/tags/name		remove a tag from one's documents
+// Tag names are path-escaped (eg. /r/ is %2Fr%2F).
+// Scripts authenticate with personal tokens, cf. tokens.go.
+// Documents are exchanged as Doc; errors as {"Error": "..."},
+// with a meaningful status code. Searches accept sort, limit
+// and cursor parameters (cf. page.go); the next page, if any,
+// is given by a Link: <url>; rel="next" header.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const apiprefix = "/api/v1/"
+
+// maximum size of a request body
+const maxbody = 1 << 20
+
+type apiError struct {
+	Error	string
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		LogError(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &apiError{ err.Error() })
+}
+
+// write a Store error (cf. errors.go)
+func writeStoreError(w http.ResponseWriter, err error) {
+	status, err := httpError(err)
+	writeError(w, status, err)
+}
+
+// API entry point; authenticated by API token (cf. tokens.go),
+// or as for the HTML pages.
+func api(w http.ResponseWriter, r *http.Request) {
+	var uid int32
+
+	if t, ok, err := bearer(r); ok {
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if t.Scope != "write" && r.Method != "GET" {
+			writeError(w, http.StatusForbidden, errors.New("Read-only token"))
+			return
+		}
+		uid = t.Uid
+	} else if uid, err = ChainToken(w, r); err != nil {
+		writeError(w, http.StatusUnauthorized, errors.New("Invalid token"))
+		return
+	} else if r.Method != "GET" && !checkCsrf(r) {
+		writeError(w, http.StatusForbidden, errors.New("Invalid or missing CSRF token"))
+		return
+	}
+
+	apiv1(w, r, uid)
+}
+
+// route authenticated requests; paths are resource[/id]. ids
+// are split from the escaped path, as tag names may contain
+// slashes (eg. /r/ is /api/v1/tags/%2Fr%2F).
+func apiv1(w http.ResponseWriter, r *http.Request, uid int32) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), apiprefix)
+	res, id, _ := strings.Cut(path, "/")
+	id, err := url.PathUnescape(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("No such resource"))
+		return
+	}
+
+	switch {
+	case res == "docs" && id == "":
+		apiDocs(w, r, uid)
+	case res == "docs":
+		i, err := strconv.ParseInt(id, 10, 32)
+		if err != nil {
+			writeError(w, http.StatusNotFound, ErrNotFound)
+			return
+		}
+		apiDoc(w, r, uid, int32(i))
+	case res == "tags" && id == "":
+		apiTags(w, r, uid)
+	case res == "tags":
+		apiTag(w, r, uid, id)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("No such resource"))
+	}
+}
+
+// read a document from r's body
+func readDoc(w http.ResponseWriter, r *http.Request) (d Doc, err error) {
+	if err = readJSON(w, r, &d); err != nil {
+		return
+	}
+
+	d.Tags = cleanTags(d.Tags)
+	d.Content = strings.TrimSpace(d.Content)
+	if d.Type == "" {
+		d.Type = getType(d.Content)
+	}
+
+	switch {
+	case len(d.Tags) == 0:
+		err = ErrNoTags
+	case !validType(d.Type):
+		err = invalidType(d.Type)
+	}
+
+	return
+}
+
+// /api/v1/docs
+func apiDocs(w http.ResponseWriter, r *http.Request, uid int32) {
+	switch r.Method {
+	case "GET":
+		q, err := ParseQuery(r.FormValue("q"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		p, err := readPage(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ds, err := db.GetDocs(uid, q, p)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if ds == nil {
+			ds = []Doc{}
+		}
+		if p.Next != "" {
+			v := r.URL.Query()
+			v.Set("cursor", p.Next)
+			w.Header().Set("Link", "<"+apiprefix+"docs?"+v.Encode()+`>; rel="next"`)
+		}
+		writeJSON(w, http.StatusOK, ds)
+	case "POST":
+		d, err := readDoc(w, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		d.Uid = uid
+		if d.Id, err = db.AddDoc(&d); err == nil {
+			d, err = db.GetDoc(d.Id)
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("Location", apiprefix+"docs/"+strconv.Itoa(int(d.Id)))
+		writeJSON(w, http.StatusCreated, d)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Bad method"))
+	}
+}
+
+// /api/v1/docs/id
+func apiDoc(w http.ResponseWriter, r *http.Request, uid, id int32) {
+	d, err := db.GetDoc(id)
+
+	switch {
+	case err != nil:
+	// don't tell about documents one can't read
+	case d.Uid != uid && !TagExpr(":public").Match(&d):
+		err = ErrNotFound
+	case r.Method != "GET" && d.Uid != uid:
+		err = ErrForbidden
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, d)
+	case "PUT":
+		n, err := readDoc(w, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		n.Id, n.Uid = id, uid
+		if err = db.UpdateDoc(&n); err == nil {
+			n, err = db.GetDoc(id)
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, n)
+	case "DELETE":
+		if err := db.DelDoc(id); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Bad method"))
+	}
+}
+
+// read JSON from r's body in v
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxbody)).Decode(v)
+	if err != nil {
+		return errors.New("Bad JSON: "+err.Error())
+	}
+	return nil
+}
+
+// /api/v1/tags
+func apiTags(w http.ResponseWriter, r *http.Request, uid int32) {
+	switch r.Method {
+	case "GET":
+		ts, err := db.GetTags(uid)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if ts == nil {
+			ts = []Tag{}
+		}
+		writeJSON(w, http.StatusOK, ts)
+	case "POST":
+		var m struct {
+			From	[]string
+			To		string
+		}
+		if err := readJSON(w, r, &m); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := db.MergeTags(uid, m.From, m.To); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Bad method"))
+	}
+}
+
+// /api/v1/tags/name
+func apiTag(w http.ResponseWriter, r *http.Request, uid int32, name string) {
+	var err error
+
+	switch r.Method {
+	case "PUT":
+		var t struct {
+			Name	string
+		}
+		if err = readJSON(w, r, &t); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = db.MergeTags(uid, []string{ name }, t.Name)
+	case "DELETE":
+		err = db.DelTag(uid, name)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Bad method"))
+		return
+	}
+
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
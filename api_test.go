@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// send an API request as uid; decode the answer in v if not nil
+func call(t *testing.T, uid int32, method, path, body string, v interface{}) int {
+	r := httptest.NewRequest(method, apiprefix+path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	apiv1(w, r, uid)
+
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func TestAPI(t *testing.T) {
+	db = NewMemStore()
+
+	var d Doc
+	code := call(t, 1, "POST", "docs", `{
+		"Name"		:	"Slackware",
+		"Content"	:	"http://www.slackware.com/",
+		"Tags"		:	["bookmarks", "linux"]
+	}`, &d)
+	if code != http.StatusCreated || d.Id == -1 || d.Type != "url" || d.Uid != 1 {
+		t.Fatal("Cannot add document:", code, d)
+	}
+	id := "docs/"+strconv.Itoa(int(d.Id))
+
+	var e apiError
+	for _, body := range []string{
+		`{ "Name" : "notags", "Content" : "x" }`,
+		`{ "Name" : "badtype", "Type" : "exe", "Tags" : ["x"] }`,
+		`not json`,
+	} {
+		if code := call(t, 1, "POST", "docs", body, &e); code != http.StatusBadRequest {
+			t.Error("Bad document added:", body, code)
+		}
+	}
+
+	var ds []Doc
+	if code := call(t, 1, "GET", "docs?q=linux+-windows", "", &ds); code != 200 || len(ds) != 1 {
+		t.Error("Bad search:", code, ds)
+	}
+	if code := call(t, 1, "GET", "docs?q=(linux", "", &e); code != http.StatusBadRequest {
+		t.Error("Bad query accepted:", code)
+	}
+
+	// private to uid 1
+	if code := call(t, 2, "GET", id, "", &e); code != http.StatusNotFound {
+		t.Error("Foreign document read:", code)
+	}
+	if code := call(t, 2, "DELETE", id, "", &e); code != http.StatusNotFound {
+		t.Error("Foreign document deleted:", code)
+	}
+
+	code = call(t, 1, "PUT", id, `{
+		"Name"		:	"Slackware Linux",
+		"Content"	:	"http://www.slackware.com/",
+		"Tags"		:	["linux", "distro", ":public"]
+	}`, &d)
+	if code != 200 || d.Name != "Slackware Linux" || len(d.Tags) != 3 {
+		t.Error("Cannot update document:", code, d)
+	}
+
+	// now public, yet not writable
+	if code := call(t, 2, "GET", id, "", &d); code != 200 {
+		t.Error("Public document not readable:", code)
+	}
+	if code := call(t, 2, "PUT", id, `{ "Tags" : ["x"] }`, &e); code != http.StatusForbidden {
+		t.Error("Foreign document updated:", code)
+	}
+
+	var ts []Tag
+	if code := call(t, 1, "GET", "tags", "", &ts); code != 200 || len(ts) != 3 {
+		t.Error("Bad tags:", code, ts)
+	}
+
+	if code := call(t, 1, "DELETE", id, "", nil); code != http.StatusNoContent {
+		t.Error("Cannot delete document:", code)
+	}
+	if code := call(t, 1, "GET", id, "", &e); code != http.StatusNotFound {
+		t.Error("Deleted document found:", code)
+	}
+
+	if code := call(t, 1, "GET", "nope", "", &e); code != http.StatusNotFound {
+		t.Error("Unknown resource found:", code)
+	}
+	if code := call(t, 1, "PATCH", "docs", "", &e); code != http.StatusMethodNotAllowed {
+		t.Error("Bad method accepted:", code)
+	}
+}
+
+func TestAPITags(t *testing.T) {
+	db = NewMemStore()
+	for _, tags := range [][]string{ {"go", "golang"}, {"golang", "c"} } {
+		mustAdd(t, db, &Doc{ Id : -1, Name : "x", Type : "text", Content : "x", Uid : 1, Tags : tags })
+	}
+
+	var e apiError
+	for _, test := range []struct {
+		method, path, body	string
+		code				int
+	}{
+		{ "PUT", "tags/c", `{ "Name" : "clang" }`, http.StatusNoContent },
+		{ "PUT", "tags/nope", `{ "Name" : "x" }`, http.StatusNotFound },
+		{ "PUT", "tags/clang", `{ "Name" : ":public" }`, http.StatusForbidden },
+		{ "PUT", "tags/clang", `not json`, http.StatusBadRequest },
+		{ "POST", "tags", `{ "From" : ["go", "golang"], "To" : "go" }`, http.StatusNoContent },
+		{ "POST", "tags", `{ "From" : ["go"], "To" : "" }`, http.StatusBadRequest },
+		{ "DELETE", "tags/clang", "", http.StatusNoContent },
+		{ "DELETE", "tags/clang", "", http.StatusNotFound },
+		{ "PATCH", "tags/go", "", http.StatusMethodNotAllowed },
+	} {
+		var v interface{}
+		if test.code != http.StatusNoContent {
+			v = &e
+		}
+		if code := call(t, 1, test.method, test.path, test.body, v); code != test.code {
+			t.Error("Bad status:", test, code, e)
+		}
+	}
+
+	var ts []Tag
+	if code := call(t, 1, "GET", "tags", "", &ts); code != 200 || len(ts) != 1 ||
+	   ts[0].Name != "go" || ts[0].Count != 2 {
+		t.Error("Bad tags:", code, ts)
+	}
+
+	// slashes are part of tag names
+	mustAdd(t, db, &Doc{ Id : -1, Name : "x", Type : "text", Content : "x", Uid : 1, Tags : []string{"/r/"} })
+	if code := call(t, 1, "PUT", "tags/%2Fr%2F", `{ "Name" : "reddit" }`, nil); code != http.StatusNoContent {
+		t.Error("Cannot rename /r/:", code)
+	}
+	if ts := tagsOf(t, db, 1); len(ts) != 2 || ts[1].Name != "reddit" {
+		t.Error("Bad rename:", ts)
+	}
+	if code := call(t, 1, "DELETE", "tags/reddit%2F", "", &e); code != http.StatusNotFound {
+		t.Error("Unknown tag deleted:", code)
+	}
+}
+
+func TestBearer(t *testing.T) {
+	db = NewMemStore()
+
+	tokens := map[string]string{}
+	for _, scope := range []string{ "read", "write" } {
+		token, hash, _ := newToken()
+		if _, err := db.AddToken(&Token{ Uid : 1, Scope : scope }, hash); err != nil {
+			t.Fatal(err)
+		}
+		tokens[scope] = token
+	}
+
+	for _, test := range []struct {
+		auth, method	string
+		code			int
+	}{
+		{ "Bearer "+tokens["read"], "GET", http.StatusOK },
+		{ "Bearer "+tokens["read"], "POST", http.StatusForbidden },
+		{ "Bearer "+tokens["write"], "POST", http.StatusCreated },
+		{ "Bearer nope", "GET", http.StatusUnauthorized },
+		{ "Basic "+tokens["write"], "GET", http.StatusUnauthorized },
+	} {
+		r := httptest.NewRequest(test.method, apiprefix+"docs",
+			strings.NewReader(`{ "Content" : "x", "Tags" : ["x"] }`))
+		r.Header.Set("Authorization", test.auth)
+		w := httptest.NewRecorder()
+		api(w, r)
+		if w.Code != test.code {
+			t.Error("Bad status:", test, w.Code)
+		}
+	}
+}
+
+func TestAPIPages(t *testing.T) {
+	db = NewMemStore()
+	for _, n := range []string{ "c", "a", "b" } {
+		mustAdd(t, db, &Doc{ Id : -1, Name : n, Type : "text", Content : n, Uid : 1, Tags : []string{"x"} })
+	}
+
+	var names []string
+	path := apiprefix+"docs?q=x&sort=name&limit=2"
+	for path != "" {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		apiv1(w, r, 1)
+
+		var ds []Doc
+		if err := json.Unmarshal(w.Body.Bytes(), &ds); err != nil || len(ds) > 2 {
+			t.Fatal("Bad page:", path, w.Body.String())
+		}
+		for _, d := range ds {
+			names = append(names, d.Name)
+		}
+
+		path = ""
+		if l := w.Header().Get("Link"); l != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(l, "<"), `>; rel="next"`)
+		}
+	}
+	if strings.Join(names, "") != "abc" {
+		t.Error("Bad pages:", names)
+	}
+
+	var e apiError
+	for _, q := range []string{ "sort=size", "limit=-1", "limit=x", "cursor=nope!" } {
+		if code := call(t, 1, "GET", "docs?"+q, "", &e); code != http.StatusBadRequest {
+			t.Error("Bad page accepted:", q, code)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"github.com/gorilla/securecookie"
-	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -11,93 +10,128 @@ import (
 )
 
 const (
-	authserver	=	"https://localhost:8080/"
-	key = "yaki6m6XctAFmKjJupcPkWAEbFSvpxNHifch4Nyx44aAnAzBBYtZ8UqKbzRUqJnr"
 	cname = "tags-token"
-
 )
 
 var (
-	Client = &http.Client{}
+	// cookie codecs, first one encodes; ephemeral unless
+	// loaded from a file, cf. keys.go
+	codecs = securecookie.CodecsFromPairs(genPair()...)
 
-	hashKey = []byte(securecookie.GenerateRandomKey(32))
-	blockKey = []byte(securecookie.GenerateRandomKey(32))
-	s = securecookie.New(hashKey, blockKey)
+	// authentication provider, cf. -auth
+	auth Authenticator
 )
 
-// Clean name for safe mkdir
-func cleanName(name string) string {
-	return strings.Join(strings.FieldsFunc(name, func (r rune) bool {
-		return r == '/' || r == '.'
-	}), "")
-}
-
-func mkr(descr string) (string, error) {
-	resp, err := Client.Get(authserver+"/api/"+descr+"&key="+key)
-	// XXX make sure err doesn't embed sensible data (eg. key…)
-	if err != nil { return "", err }
-
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil { return "", err }
+var (
+	ErrBadLogin = errors.New("Wrong token/email/name")
+	// remote auth has sent a new token to the user
+	ErrNewToken = errors.New("Check your AAS account!")
+)
 
-	return string(body), nil
+// Authenticator checks users' credentials, and the tokens
+// stored in their cookie.
+type Authenticator interface {
+	// check the login form; returns a token for the user
+	Login(r *http.Request) (token string, uid int32, err error)
+	// check token; returns the token to use next
+	Chain(token string) (string, error)
+	Logout(token string)
+	// login form file
+	Form() string
 }
 
-func update() {
+// Authenticators which can create accounts.
+type Registerer interface {
+	// check the registration form; returns the new user's id
+	Register(r *http.Request) (uid int32, err error)
 }
 
-func login2(login string) (string, error) {
-	return mkr("login?login="+login)
+// Available authenticators, by name.
+var authenticators = map[string]func() (Authenticator, error){
+	"remote": func() (Authenticator, error) {
+		a, err := NewRemoteAuth(*authserver, *authkey, "auth-cert.pem")
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	},
+	"local": func() (Authenticator, error) {
+		return &LocalAuth{}, nil
+	},
 }
 
-func chain(token string) (string, error) {
-	return mkr("chain?token="+token)
+// NewAuth creates the authenticator named name.
+func NewAuth(name string) (Authenticator, error) {
+	mk, ok := authenticators[name]
+	if !ok {
+		return nil, errors.New("unknown authenticator: "+name)
+	}
+	return mk()
 }
 
-func info(token string) (string, error) {
-	return mkr("info?token="+token)
+// Clean name for safe mkdir
+func cleanName(name string) string {
+	return strings.Join(strings.FieldsFunc(name, func (r rune) bool {
+		return r == '/' || r == '.'
+	}), "")
 }
 
-func logout2(token string) {
-	mkr("logout?token="+token)
+func update() {
 }
 
 // retrieve token; chain it to the auth server
 // return data stored in cookie or err
 func ChainToken(w http.ResponseWriter, r *http.Request) (int32, error) {
 	token, uid, err := getToken(r)
-	if err == nil { token, err = chain(token) }
+	if err == nil { token, err = auth.Chain(token) }
 	if err != nil { LogError(err); return 0, err }
 
-	if token == "ko" {
-		return 0, errors.New("bad token")
-	}
-
 	// previous token was valid, set new token
-	err = setToken(w, token, uid)
+	err = setToken(w, r, token, uid)
 
 	return uid, err
 }
 
-func setToken(w http.ResponseWriter, token string, uid int32) error {
+// store token in the cookie, or in the session if server-side
+// sessions are enabled (the cookie then holds the session id).
+func setToken(w http.ResponseWriter, r *http.Request, token string, uid int32) error {
+	csrf, err := nextCsrf(r, uid)
+	if err != nil {
+		return err
+	}
+
 	value := map[string]interface{}{
 		"token"	:	token,
 		"uid"	:	uid,
+		"csrf"	:	csrf,
      	}
-  
-	if encoded, err := s.Encode(cname, value); err == nil {
-		cookie := &http.Cookie{
-			Name:	cname,
-			Value:	encoded,
-			Path:	"/",
+
+	if sessions != nil {
+		sid, err := touchSession(r, token, uid)
+		if err != nil {
+			return err
 		}
-		http.SetCookie(w, cookie)
-	} else {
-		return err
+		value["token"], value["sid"] = "", sid
 	}
 
-	return nil
+	_, err = writeCookie(w, value)
+	return err
+}
+
+// store value in the cookie
+func writeCookie(w http.ResponseWriter, value map[string]interface{}) (*http.Cookie, error) {
+	encoded, err := securecookie.EncodeMulti(cname, value, codecs...)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := &http.Cookie{
+		Name:	cname,
+		Value:	encoded,
+		Path:	"/",
+	}
+	http.SetCookie(w, cookie)
+	return cookie, nil
 }
 
 func unsetToken(w http.ResponseWriter) {
@@ -109,14 +143,42 @@ func unsetToken(w http.ResponseWriter) {
 	http.SetCookie(w, cookie)
 }
 
+func readCookie(r *http.Request) (map[string]interface{}, error) {
+	cookie, err := r.Cookie(cname)
+	if err != nil {
+		return nil, err
+	}
+
+	value := map[string]interface{}{}
+	err = securecookie.DecodeMulti(cname, cookie.Value, &value, codecs...)
+	return value, err
+}
+
+// session id in r's cookie, if any
+func cookieSid(r *http.Request) string {
+	value, err := readCookie(r)
+	if err != nil {
+		return ""
+	}
+	sid, _ := value["sid"].(string)
+	return sid
+}
+
 func getToken(r *http.Request) (token string, uid int32, err error) {
-	if cookie, err := r.Cookie(cname); err == nil {
-		value := map[string]interface{}{}
+	value, err := readCookie(r)
+	if err != nil {
+		return "", 0, err
+	}
 
-		if err = s.Decode(cname, cookie.Value, &value); err == nil {
-			return value["token"].(string), value["uid"].(int32), nil
-		}
+	if sid, ok := value["sid"].(string); ok {
+		return sessionToken(sid)
 	}
 
-	return "", 0, err
+	// pre-session cookies only have a csrf token (cf. csrf.go)
+	token, ok := value["token"].(string)
+	uid, ok2 := value["uid"].(int32)
+	if !ok || !ok2 {
+		return "", 0, errors.New("no token")
+	}
+	return token, uid, nil
 }
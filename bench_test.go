@@ -0,0 +1,114 @@
+package main
+
+// Search benchmarks, on generated datasets:
+//	go test -run X -bench Search
+// Datasets are added to a fresh store per backend and size,
+// under their own uid (PostgreSQL's is removed afterwards).
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var benchsizes = []int{ 10000, 100000 }
+
+var benchwords = strings.Fields(`gopher channel goroutine interface
+	physics maths quantum lattice paper bookmark linux kernel`)
+
+// n-th generated document
+func benchDoc(n int, uid int32) Doc {
+	var ws []string
+	for i := 0; i < 20; i++ {
+		ws = append(ws, benchwords[(n*7+i*i)%len(benchwords)])
+	}
+	tags := []string{ "t"+strconv.Itoa(n%10), "u"+strconv.Itoa(n%97) }
+	if n%5 == 0 {
+		tags = append(tags, ":public")
+	}
+	return Doc{ Id : -1, Name : "doc "+strconv.Itoa(n), Type : "text",
+		Content : strings.Join(ws, " "), Uid : uid, Tags : tags,
+		Created : time.Now().UTC().Add(-time.Duration(n)*time.Minute) }
+}
+
+// fill st with n documents owned by uid
+func benchFill(b *testing.B, st Store, n int, uid int32) {
+	// one transaction, rather than one per document
+	if db, ok := st.(*Database); ok {
+		err := db.inTx(func(tx *Tx) error {
+			for i := 0; i < n; i++ {
+				d := benchDoc(i, uid)
+				var id int32
+				err := tx.QueryRow(`INSERT INTO docs(name, type, content, uid, created, updated)
+					VALUES ($1, $2, $3, $4, $5, $5)
+					RETURNING id`, d.Name, d.Type, d.Content, d.Uid, d.Created).Scan(&id)
+				if err == nil {
+					err = tx.addTags(uid, id, d.Tags)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		d := benchDoc(i, uid)
+		if _, err := st.AddDoc(&d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	queries := []struct {
+		name, query, sort	string
+	}{
+		{ "all", "", "-updated" },
+		{ "tag", "t3", "" },
+		{ "boolean", "(t1 OR u5) -t3 NOT u7", "name" },
+		{ "text", "text:gopher", "relevance" },
+		{ "public", ":public u11", "" },
+	}
+
+	for name, open := range backends {
+		for _, size := range benchsizes {
+			b.Run(fmt.Sprintf("%s/%d", name, size), func(b *testing.B) {
+				st, err := open(b)
+				if err != nil {
+					b.Skip("backend unavailable:", err)
+				}
+				uid := int32(3000000+size)
+				benchFill(b, st, size, uid)
+				if db, ok := st.(*Database); ok {
+					defer func() {
+						db.Exec(`DELETE FROM docs WHERE uid = $1`, uid)
+						db.Exec(`DELETE FROM tags WHERE uid = $1`, uid)
+					}()
+				}
+
+				for _, q := range queries {
+					e, err := ParseQuery(q.query)
+					if err != nil {
+						b.Fatal(q.query, err)
+					}
+					b.Run(q.name, func(b *testing.B) {
+						for i := 0; i < b.N; i++ {
+							p := &Page{ Sort : q.sort, Limit : 50 }
+							if ds := docsOf(b, st, uid, e, p); len(ds) == 0 {
+								b.Fatal("No results:", q.query)
+							}
+						}
+					})
+				}
+			})
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"strings"
+	"time"
+)
+
 const TagSep = "\u001F"
 
 // Id is int32 so it matches INTEGER (SERIAL is INTEGER)
@@ -13,4 +18,126 @@ type Doc struct {
 	Content		string
 	Uid			int32		// Id given by Auth
 	Tags		[]string
+	Created		time.Time
+	Updated		time.Time
+}
+
+// Tag, as listed for a user: Count is the number of
+// documents holding it.
+type Tag struct {
+	Name		string
+	Count		int
+}
+
+// Tags belong to their user, save for system tags (eg.
+// :public), which start with a colon and are shared.
+func isSystemTag(name string) bool {
+	return strings.HasPrefix(name, ":")
+}
+
+// owner of uid's tag name; 0 for system tags
+func tagOwner(uid int32, name string) int32 {
+	if isSystemTag(name) {
+		return 0
+	}
+	return uid
+}
+
+// Tags are hierarchical: science/physics is a child of
+// science, and is found when searching for science. Leading
+// and trailing separators don't count (/r/ has no parent,
+// nor children); repeated ones count as one. System tags are
+// flat.
+const TagPathSep = "/"
+
+// can tag name have children?
+func tagBranch(name string) bool {
+	return name != "" && !isSystemTag(name) && !strings.HasSuffix(name, TagPathSep)
+}
+
+// is tag name, or one of its descendants?
+func tagUnder(tag, name string) bool {
+	if tag == name {
+		return true
+	}
+	rest, ok := strings.CutPrefix(tag, name+TagPathSep)
+	return ok && tagBranch(name) && strings.TrimLeft(rest, TagPathSep) != ""
+}
+
+// parent of tag name, "" if none
+func tagParent(name string) string {
+	if isSystemTag(name) {
+		return ""
+	}
+	path := strings.TrimRight(name, TagPathSep)
+	lead := len(path)-len(strings.TrimLeft(path, TagPathSep))
+	if i := strings.LastIndex(path[lead:], TagPathSep); i > 0 {
+		return strings.TrimRight(path[:lead+i], TagPathSep)
+	}
+	return ""
+}
+
+// last element of tag name's path
+func tagBase(name string) string {
+	base := strings.Trim(name, TagPathSep)
+	if i := strings.LastIndex(base, TagPathSep); i >= 0 && !isSystemTag(name) {
+		base = base[i+1:]
+	}
+	if base == "" {
+		return name
+	}
+	return base
+}
+
+// Personal API token; only a hash of the token itself
+// is stored. Scope is "read" (GET only) or "write".
+type Token struct {
+	Id			int32
+	Uid			int32
+	Name		string
+	Scope		string
+	Created		time.Time
+}
+
+// Local account, cf. local.go; Hash is bcrypt'd.
+type User struct {
+	Id			int32
+	Name		string
+	Hash		string
+}
+
+// Server-side session, cf. sessions.go; Token is the
+// authenticator's.
+type Session struct {
+	Id			string
+	Uid			int32
+	Token		string
+	Agent		string		// User-Agent
+	Addr		string
+	Created		time.Time
+	Seen		time.Time
+}
+
+// Per-user preferences, cf. settings.go
+type Prefs struct {
+	Tags		[]string	// added to new documents
+	Search		string		// default search
+	PageSize	int			// documents per page, 0 for all
+	Public		bool		// new documents are :public
+	Format		string		// text documents formatter
+}
+
+// Past version of a document, saved by UpdateDoc: Doc is the
+// version (its Updated field being when it was made), replaced
+// at Saved.
+type Revision struct {
+	Id			int32
+	Doc			Doc
+	Saved		time.Time
+}
+
+// Document in the trash, since Deleted
+type Trashed struct {
+	Doc
+	Deleted		time.Time
 }
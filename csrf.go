@@ -0,0 +1,74 @@
+package main
+
+// CSRF protection: each session gets a random token, kept in the
+// (signed and encrypted) cookie, that state-changing forms must
+// send back in their csrf field (scripts using the cookie with
+// the JSON API, in an X-CSRF-Token header). Checked by tags()
+// and api().
+//
+// Login and register forms are posted before any session
+// exists: their token lives in a session-less cookie, issued
+// when the form is displayed (cf. preCsrf), so that other sites
+// can't log users into an account of their choosing either.
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// csrf token of r's session, "" if none
+func csrfToken(r *http.Request) string {
+	value, err := readCookie(r)
+	if err != nil {
+		return ""
+	}
+	c, _ := value["csrf"].(string)
+	return c
+}
+
+// csrf token to store in a cookie for uid: r's one if
+// it belongs to the same user, a new one otherwise.
+func nextCsrf(r *http.Request, uid int32) (string, error) {
+	if value, err := readCookie(r); err == nil && value["uid"] == uid {
+		if c, _ := value["csrf"].(string); c != "" {
+			return c, nil
+		}
+	}
+	return newSid()
+}
+
+// pages posted before any session exists
+var presession = map[string]bool{
+	"login"		:	true,
+	"register"	:	true,
+}
+
+// preCsrf gives r a session-less cookie holding a new csrf
+// token, unless r already has one.
+func preCsrf(w http.ResponseWriter, r *http.Request) error {
+	if csrfToken(r) != "" {
+		return nil
+	}
+
+	c, err := newSid()
+	if err != nil {
+		return err
+	}
+	cookie, err := writeCookie(w, map[string]interface{}{ "csrf" : c })
+	if err == nil {
+		// for the form to be displayed (cf. csrfToken)
+		r.AddCookie(cookie)
+	}
+	return err
+}
+
+// checkCsrf reports whether r carries its session's token.
+func checkCsrf(r *http.Request) bool {
+	x := r.Header.Get("X-CSRF-Token")
+	if x == "" {
+		x = r.FormValue("csrf")
+	}
+
+	c := csrfToken(r)
+	return c != "" && subtle.ConstantTimeCompare([]byte(c), []byte(x)) == 1
+}
@@ -14,277 +14,1142 @@ import (
 	_ "github.com/lib/pq"
 	"database/sql"
 	"errors"
-	"log"
 	"strings"
 	"strconv"
+	"time"
+	"unicode/utf8"
 )
 
+// Database is the SQL Store; the dialect hides differences
+// between PostgreSQL (default) and SQLite.
 type Database struct {
 	*sql.DB
-	tagcache	map[string]int32
+	dialect		*dialect
+	tagcache	*tagCache
+	notify		bool		// broadcast tag invalidations (cf. tagcache.go)
 }
 
+// dialect gathers what differs between SQL backends.
+type dialect struct {
+	driver		string
+	// fills in default data source/options
+	dsn			func(string) string
+	// schema versions; cf. migrate.go
+	migrations	[]migration
+	// aggregates tags.name, separated by TagSep
+	tagsagg		string
+	// rewrites $n placeholders if needed
+	rebind		func(string) string
+	// full-text: condition on docs containing all words ws,
+	// and relevance of docs for ws, with the join it needs if
+	// any; parameters go to args.
+	text		func(ws []string, args *[]interface{}) string
+	rank		func(ws []string, args *[]interface{}) (join, expr string)
+}
+
+var postgres = &dialect{
+	driver		:	"postgres",
+	dsn			:	pgDSN,
+	migrations	:	pgMigrations,
+	tagsagg		:	`string_agg(tags.name, U&'\001F')`,
+	rebind		:	func(q string) string { return q },
+	text		:	pgText,
+	rank		:	pgRank,
+}
+
+// SQL backends, by name
+var dialects = map[string]*dialect{
+	"postgres"	:	postgres,
+	"sqlite"	:	sqlite,
+}
+
+// default PostgreSQL connection string
 // XXX add password; check for clean user setup; check SSL
-//func NewDB(dbname string) (db *Database) {
-func NewDB() (db *Database) {
-	tmp, err := sql.Open("postgres",
-		"dbname=stags user=stags host=localhost sslmode=disable")
+const pgdsn = "dbname=stags user=stags host=localhost sslmode=disable"
+
+func pgDSN(dsn string) string {
+	if dsn == "" {
+		return pgdsn
+	}
+	return dsn
+}
+
+// OpenDB connects to PostgreSQL and migrates the schema if needed.
+func OpenDB(dsn string) (*Database, error) {
+	db, err := initDB(postgres, dsn)
+	if err != nil || !*tagnotify {
+		return db, err
+	}
+
+	if err := db.listen(pgDSN(dsn)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.notify = true
+
+	return db, nil
+}
+
+// open the database, without touching the schema.
+func openDB(d *dialect, dsn string) (*Database, error) {
+	tmp, err := sql.Open(d.driver, d.dsn(dsn))
 	if err != nil {
-		LogFatal(err)
-	} else {
-		db = &Database{ tmp, make(map[string]int32) }
-		db.Init()
+		return nil, err
 	}
 
-	return
+	return &Database{ tmp, d, newTagCache(*tagcachesize), false }, nil
 }
 
-func (db *Database) createFatal(descr string) {
-	_, err := db.Query(descr)
+func initDB(d *dialect, dsn string) (*Database, error) {
+	db, err := openDB(d, dsn)
 	if err != nil {
-		LogFatal(err)
-	}
-}
-
-// Create tables if needed.
-func (db *Database) createTables() {
-	row, err := db.Query("SELECT 1 FROM pg_type WHERE typname = 'dtype'")
-	// if dtype doesn't exist, create it.
-	// XXX ADD NEW TYPES AT THE END IN PRODUCTION
-	if err == nil && !row.Next() {
-		db.createFatal(`CREATE TYPE dtype AS ENUM
-			(
-				'text',
-				'url',
-				'pdf',
-				'ps'
-			)
-		`)
-	}
-
-	db.createFatal(`CREATE TABLE IF NOT EXISTS
-		docs(
-			id			SERIAL,
-			name		TEXT,
-			type		DTYPE,
-			content		TEXT,
-			uid			INT,
-			PRIMARY KEY ("id")
-		)
-	`)
-
-	db.createFatal(`CREATE TABLE IF NOT EXISTS
-		tags(
-			id			SERIAL,
-			name		TEXT		UNIQUE,
-			PRIMARY KEY ("id")
-		)
-	`)
-
-	db.createFatal(`CREATE TABLE IF NOT EXISTS
-		tagsdocs(
-			idtag		INTEGER	REFERENCES	tags(id)	ON DELETE CASCADE,
-			iddoc		INTEGER	REFERENCES	docs(id)	ON DELETE CASCADE
-		)
-	`)
-}
-
-func (db *Database) loadTagCache() {
-	rows, err := db.Query("SELECT id, name FROM tags")
+		return nil, err
+	}
+
+	if err := db.Init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Query, QueryRow and Exec shadow sql.DB's to handle placeholders.
+func (db *Database) Query(q string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(q), args...)
+}
+
+func (db *Database) QueryRow(q string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(q), args...)
+}
+
+func (db *Database) Exec(q string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(q), args...)
+}
+
+// Tx is a transaction, shadowing sql.Tx's methods likewise.
+type Tx struct {
+	*sql.Tx
+	db		*Database
+	tags	map[tagKey]int32	// tags created, cached once committed
+	forget	[]tagKey			// tags invalidated, likewise
+	gen		uint64				// of the tag cache, when tx began
+}
+
+func (tx *Tx) Query(q string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.db.dialect.rebind(q), args...)
+}
+
+func (tx *Tx) QueryRow(q string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.db.dialect.rebind(q), args...)
+}
+
+func (tx *Tx) Exec(q string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.dialect.rebind(q), args...)
+}
+
+// Database or Tx
+type querier interface {
+	Query(q string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(q string, args ...interface{}) *sql.Row
+	Exec(q string, args ...interface{}) (sql.Result, error)
+}
+
+// inTx runs f in a transaction, committed if f succeeds.
+func (db *Database) inTx(f func(tx *Tx) error) error {
+	gen := db.tagcache.Gen()
+	t, err := db.Begin()
 	if err != nil {
-		LogFatal(errors.New("Cannot load tag cache"))
+		return err
 	}
 
+	tx := &Tx{ t, db, make(map[tagKey]int32), nil, gen }
+	if err := f(tx); err != nil {
+		t.Rollback()
+		return err
+	}
+	if err := t.Commit(); err != nil {
+		return err
+	}
+
+	db.tagcache.Commit(tx.gen, tx.forget, tx.tags)
+	return nil
+}
+
+func (db *Database) create(descr string) error {
+	_, err := db.Exec(descr)
+	return err
+}
+
+// documents' words, for full-text search; the expression is
+// indexed, cf. migration 3.
+const pgtsv = `to_tsvector('simple', coalesce(name, '') || ' ' || coalesce(content, ''))`
+
+func pgText(ws []string, args *[]interface{}) string {
+	return pgtsv+` @@ plainto_tsquery('simple', `+arg(args, strings.Join(ws, " "))+`)`
+}
+
+// ws are made of letters and digits only, cf. words()
+func pgRank(ws []string, args *[]interface{}) (string, string) {
+	return "", `ts_rank(`+pgtsv+`, to_tsquery('simple', `+arg(args, strings.Join(ws, " | "))+`))`
+}
+
+// PostgreSQL schema versions.
+// New document types: ALTER TYPE dtype ADD VALUE 'x'; it can't
+// be undone, and can't run in a transaction before PostgreSQL 12.
+var pgMigrations = []migration{
+	// 1: initial schema; existing (unversioned) deployments
+	// already have it, hence the IF NOT EXISTS.
+	{
+		up : `
+			DO $$ BEGIN
+				IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'dtype') THEN
+					CREATE TYPE dtype AS ENUM
+					(
+						'text',
+						'url',
+						'pdf',
+						'ps'
+					);
+				END IF;
+			END $$;
+
+			CREATE TABLE IF NOT EXISTS
+			docs(
+				id			SERIAL,
+				name		TEXT,
+				type		DTYPE,
+				content		TEXT,
+				uid			INT,
+				PRIMARY KEY ("id")
+			);
+
+			CREATE TABLE IF NOT EXISTS
+			tags(
+				id			SERIAL,
+				name		TEXT		UNIQUE,
+				PRIMARY KEY ("id")
+			);
+
+			CREATE TABLE IF NOT EXISTS
+			tagsdocs(
+				idtag		INTEGER	REFERENCES	tags(id)	ON DELETE CASCADE,
+				iddoc		INTEGER	REFERENCES	docs(id)	ON DELETE CASCADE
+			);
+		`,
+		down : `
+			DROP TABLE tagsdocs;
+			DROP TABLE tags;
+			DROP TABLE docs;
+			DROP TYPE dtype;
+		`,
+	},
+	// 2: index the association table
+	{
+		up : `
+			CREATE INDEX tagsdocs_iddoc ON tagsdocs(iddoc);
+			CREATE INDEX tagsdocs_idtag ON tagsdocs(idtag);
+		`,
+		down : `
+			DROP INDEX tagsdocs_iddoc;
+			DROP INDEX tagsdocs_idtag;
+		`,
+	},
+	// 3: full-text search
+	{
+		up		:	`CREATE INDEX docs_fts ON docs USING GIN (`+pgtsv+`);`,
+		down	:	`DROP INDEX docs_fts;`,
+	},
+	// 4: API tokens
+	{
+		up : `
+			CREATE TABLE tokens(
+				id			SERIAL,
+				uid			INT			NOT NULL,
+				name		TEXT,
+				hash		TEXT		NOT NULL	UNIQUE,
+				scope		TEXT		NOT NULL	CHECK (scope IN ('read', 'write')),
+				created		TIMESTAMP WITH TIME ZONE	NOT NULL	DEFAULT now(),
+				PRIMARY KEY ("id")
+			);
+		`,
+		down : `DROP TABLE tokens;`,
+	},
+	// 5: local accounts
+	{
+		up : `
+			CREATE TABLE users(
+				id			SERIAL,
+				name		TEXT		NOT NULL	UNIQUE,
+				hash		TEXT		NOT NULL,
+				created		TIMESTAMP WITH TIME ZONE	NOT NULL	DEFAULT now(),
+				PRIMARY KEY ("id")
+			);
+		`,
+		down : `DROP TABLE users;`,
+	},
+	// 6: server-side sessions
+	{
+		up : `
+			CREATE TABLE sessions(
+				id			TEXT,
+				uid			INT			NOT NULL,
+				token		TEXT,
+				agent		TEXT,
+				addr		TEXT,
+				created		TIMESTAMP WITH TIME ZONE	NOT NULL,
+				seen		TIMESTAMP WITH TIME ZONE	NOT NULL,
+				PRIMARY KEY ("id")
+			);
+			CREATE INDEX sessions_uid ON sessions(uid);
+		`,
+		down : `DROP TABLE sessions;`,
+	},
+	// 7: per-user preferences
+	{
+		up : `
+			CREATE TABLE prefs(
+				uid			INT,
+				tags		TEXT		NOT NULL DEFAULT '',
+				search		TEXT		NOT NULL DEFAULT '',
+				pagesize	INT			NOT NULL DEFAULT 0,
+				public		BOOLEAN		NOT NULL DEFAULT FALSE,
+				format		TEXT		NOT NULL DEFAULT '',
+				PRIMARY KEY ("uid")
+			);
+		`,
+		down : `DROP TABLE prefs;`,
+	},
+	// 8: creation and modification dates
+	{
+		up : `
+			ALTER TABLE docs
+				ADD COLUMN created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+				ADD COLUMN updated TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+			CREATE INDEX docs_created ON docs(created);
+			CREATE INDEX docs_updated ON docs(updated);
+		`,
+		down : `
+			ALTER TABLE docs DROP COLUMN created, DROP COLUMN updated;
+		`,
+	},
+	// 9: revisions: documents' past versions
+	{
+		up : `
+			CREATE TABLE revisions(
+				id			SERIAL,
+				iddoc		INTEGER		NOT NULL	REFERENCES docs(id)	ON DELETE CASCADE,
+				name		TEXT,
+				type		DTYPE,
+				content		TEXT,
+				tags		TEXT,
+				created		TIMESTAMP WITH TIME ZONE	NOT NULL,
+				saved		TIMESTAMP WITH TIME ZONE	NOT NULL,
+				PRIMARY KEY ("id")
+			);
+			CREATE INDEX revisions_iddoc ON revisions(iddoc);
+		`,
+		down : `DROP TABLE revisions;`,
+	},
+	// 10: trash: deleted documents, until purged
+	{
+		up : `
+			ALTER TABLE docs ADD COLUMN deleted TIMESTAMP WITH TIME ZONE;
+			CREATE INDEX docs_deleted ON docs(deleted);
+		`,
+		down : `
+			DELETE FROM docs WHERE deleted IS NOT NULL;
+			ALTER TABLE docs DROP COLUMN deleted;
+		`,
+	},
+	// 11: per-user tags; system tags (:public...) are shared,
+	// with uid 0. Shared user tags are split between owners;
+	// uid 0 (or no uid) owners keep the original tags.
+	{
+		up : `
+			ALTER TABLE tags ADD COLUMN uid INT NOT NULL DEFAULT 0;
+			ALTER TABLE tags DROP CONSTRAINT tags_name_key;
+
+			INSERT INTO tags(uid, name)
+				SELECT DISTINCT coalesce(docs.uid, 0), tags.name
+				FROM tags, tagsdocs, docs
+				WHERE tagsdocs.idtag = tags.id
+				AND tagsdocs.iddoc = docs.id
+				AND tags.name NOT LIKE ':%'
+				AND coalesce(docs.uid, 0) != 0;
+			UPDATE tagsdocs SET idtag = (SELECT owned.id
+					FROM tags owned, tags shared, docs
+					WHERE shared.id = tagsdocs.idtag
+					AND docs.id = tagsdocs.iddoc
+					AND owned.uid = docs.uid
+					AND owned.name = shared.name)
+				WHERE idtag IN (SELECT id FROM tags
+					WHERE uid = 0 AND name NOT LIKE ':%')
+				AND iddoc IN (SELECT id FROM docs
+					WHERE coalesce(uid, 0) != 0);
+			DELETE FROM tags WHERE uid = 0 AND name NOT LIKE ':%'
+				AND id NOT IN (SELECT idtag FROM tagsdocs);
+
+			ALTER TABLE tags ADD CONSTRAINT tags_uid_name_key UNIQUE (uid, name);
+		`,
+		down : `
+			ALTER TABLE tags DROP CONSTRAINT tags_uid_name_key;
+
+			UPDATE tagsdocs SET idtag = (SELECT min(same.id)
+				FROM tags same, tags t
+				WHERE t.id = tagsdocs.idtag
+				AND same.name = t.name);
+			DELETE FROM tags WHERE id NOT IN (SELECT min(id) FROM tags GROUP BY name);
+
+			ALTER TABLE tags DROP COLUMN uid;
+			ALTER TABLE tags ADD CONSTRAINT tags_name_key UNIQUE (name);
+		`,
+	},
+	// 12: local accounts' login tokens
+	{
+		up : `
+			CREATE TABLE logins(
+				hash		TEXT,
+				uid			INT			NOT NULL	REFERENCES users(id)	ON DELETE CASCADE,
+				created		TIMESTAMP WITH TIME ZONE	NOT NULL	DEFAULT now(),
+				PRIMARY KEY ("hash")
+			);
+		`,
+		down : `DROP TABLE logins;`,
+	},
+}
+
+// fill the tag cache with the most recent tags
+func (db *Database) loadTagCache() error {
+	rows, err := db.Query(`SELECT id, uid, name FROM tags
+		ORDER BY id DESC LIMIT $1`, db.tagcache.size)
+	if err != nil {
+		return errors.New("Cannot load tag cache")
+	}
+	defer rows.Close()
+
+	var ts []tagEntry
 	for rows.Next() {
-		var id		int32
-		var name	string
-		rows.Scan(&id, &name)
-		db.tagcache[name] = id
+		var t tagEntry
+		rows.Scan(&t.id, &t.uid, &t.name)
+		ts = append(ts, t)
 	}
+	for i := len(ts)-1; i >= 0; i-- {
+		db.tagcache.Put(ts[i].tagKey, ts[i].id)
+	}
+	return rows.Err()
 }
 
-func (db *Database) Init() {
-	db.createTables()
-	db.loadTagCache()
+// Init brings the schema up to date (or checks it is, cf. -automigrate)
+// and loads the tag cache.
+func (db *Database) Init() error {
+	if err := db.upToDate(); err != nil {
+		return err
+	}
+	return db.loadTagCache()
 }
 
-func (db *Database) HasOwner(id, uid int32) bool {
-	err := db.QueryRow(`SELECT id FROM docs WHERE
-		id = $1 AND uid = $2`, id, uid).Scan(&id)
+func (db *Database) CheckOwner(id, uid int32) error {
+	var owner int32
+	err := db.QueryRow(`SELECT uid FROM docs WHERE
+		id = $1 AND deleted IS NULL`, id).Scan(&owner)
+	if err == nil && owner != uid {
+		err = ErrForbidden
+	}
 
-	return err == nil
+	return notFound(err)
 }
 
-func (db *Database) GetDoc(id int32) (d Doc) {
+func (db *Database) GetDoc(id int32) (Doc, error) {
+	return db.getDoc(db, id)
+}
+
+// columns read by scanDoc; tags are aggregated by a subquery,
+// so that documents can be fetched in bulk
+func (db *Database) docCols() string {
+	return `docs.id, docs.name, docs.type, docs.content, docs.uid,
+		docs.created, docs.updated,
+		coalesce((SELECT `+db.dialect.tagsagg+` FROM tagsdocs, tags
+			WHERE tagsdocs.iddoc = docs.id
+			AND tags.id = tagsdocs.idtag), '')`
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scan docCols() in d, and extra columns in extra
+func scanDoc(row scanner, d *Doc, extra ...interface{}) error {
 	var tags string
-	err := db.QueryRow(`SELECT docs.id, docs.name, docs.type,
-			docs.content, docs.uid, string_agg(tags.name, U&'\001F') AS tags
+	dest := append([]interface{}{ &d.Id, &d.Name, &d.Type, &d.Content, &d.Uid,
+		&d.Created, &d.Updated, &tags }, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	if tags != "" {
+		d.Tags = strings.Split(tags, TagSep)
+	}
+	return nil
+}
+
+// fetch live document id
+func (db *Database) getDoc(q querier, id int32) (d Doc, err error) {
+	err = scanDoc(q.QueryRow(`SELECT `+db.docCols()+` FROM docs
+		WHERE docs.id = $1
+		AND	docs.deleted IS NULL`, id), &d)
+
+	return d, notFound(err)
+}
+
+func (db *Database) GetTags(uid int32) (ts []Tag, err error) {
+	rows, err := db.Query(`SELECT tags.name, COUNT(*)
 		FROM
 			tags, tagsdocs, docs
 		WHERE
 			tagsdocs.idtag = tags.id
 		AND	tagsdocs.iddoc = docs.id
-		AND	docs.id = $1
-		GROUP BY docs.id`, id).Scan(&d.Id, &d.Name, &d.Type, &d.Content, &d.Uid, &tags)
+		AND	docs.uid = $1
+		AND	docs.deleted IS NULL
+		GROUP BY tags.name
+		ORDER BY tags.name`, uid)
 	if err != nil {
-		LogError(err)
-		d.Id = -1
-	} else {
-		d.Tags = strings.Split(tags, TagSep)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.Name, &t.Count); err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+
+	return ts, rows.Err()
 }
 
-func (db *Database) AddTag(tag string) (id int32) {
-	if strings.Contains(tag, TagSep) {
-		tag = strings.Replace(tag, TagSep, "", -1)
-	}
+// cache key of uid's tag; TagSep can't be part of names
+func cacheKey(uid int32, tag string) tagKey {
+	tag = strings.Replace(tag, TagSep, "", -1)
+	return tagKey{ tagOwner(uid, tag), tag }
+}
 
-	id = -1
-	if db.tagcache[tag] > 0 { return db.tagcache[tag] }
+// id of uid's tag, creating it if needed
+func (tx *Tx) addTag(uid int32, tag string) (id int32, err error) {
+	// tags invalidated by tx are 0 in tx.tags
+	k := cacheKey(uid, tag)
+	id, ok := tx.tags[k]
+	if id > 0 {
+		return id, nil
+	}
+	if !ok {
+		if id, ok := tx.db.tagcache.Get(k); ok {
+			return id, nil
+		}
+	}
 
-	err := db.QueryRow(`INSERT INTO tags(name) VALUES($1)
-		RETURNING id`, tag).Scan(&id)
-	if err != nil {
-		LogError(err)
-	} else {
-		db.tagcache[tag] = id
+	// may have been created concurrently
+	_, err = tx.Exec(`INSERT INTO tags(uid, name) VALUES($1, $2)
+		ON CONFLICT (uid, name) DO NOTHING`, k.uid, k.name)
+	if err == nil {
+		err = tx.QueryRow(`SELECT id FROM tags WHERE uid = $1 AND name = $2`,
+			k.uid, k.name).Scan(&id)
+	}
+	if err == nil {
+		tx.tags[k] = id
 	}
 	return
 }
 
-func (db *Database) AddTags(id int32, tags []string) {
+// tag document id with uid's tag. A cached tag id may be
+// stale (eg. the tag was deleted by another process): rather
+// than failing on the foreign key, the tag is looked up again,
+// once.
+func (tx *Tx) tagDoc(uid, id int32, tag string) error {
+	for retried := false; ; retried = true {
+		idtag, err := tx.addTag(uid, tag)
+		if err != nil {
+			return err
+		}
+		err = affected(tx.Exec(`INSERT INTO tagsdocs(idtag, iddoc)
+			SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM tags WHERE id = $1)
+			AND NOT EXISTS (SELECT 1 FROM tagsdocs
+				WHERE idtag = $1 AND iddoc = $2)`, idtag, id))
+		if err != ErrNotFound {
+			return err
+		}
+
+		// already tagged, or stale
+		k := cacheKey(uid, tag)
+		if _, ok := tx.tags[k]; ok || retried {
+			return nil
+		}
+		tx.db.tagcache.Forget(k)
+		tx.tags[k] = 0
+	}
+}
+
+// tag document id, owned by uid
+func (tx *Tx) addTags(uid, id int32, tags []string) error {
 	for _, tag := range tags {
-		idtag := db.AddTag(tag)
-		if idtag != -1 {
-			_, err := db.Query(`INSERT into tagsdocs(idtag, iddoc)
-				VALUES($1, $2)`, idtag, id)
-			if err != nil {
-				LogError(err)
-			}
+		if err := tx.tagDoc(uid, id, tag); err != nil {
+			return err
 		}
-		
 	}
+	return nil
 }
 
-func (db *Database) DelTags(id int32, tags []string) {
-	if stmt, err := db.Prepare(`DELETE FROM tagsdocs USING tags
-		WHERE
-			tagsdocs.idtag = tags.id
-		AND	tagsdocs.iddoc = $1
-		AND	tags.name IN `+mkan(2, len(tags))); err != nil {
-			log.Println(err)
-	} else {
-		if _, err := stmt.Query(id, tags); err != nil {
-			log.Println(err)
+func (db *Database) MergeTags(uid int32, from []string, to string) error {
+	if err := checkMerge(from, to); err != nil {
+		return err
+	}
+
+	args := []interface{}{ uid }
+	var conds []string
+	for _, f := range from {
+		conds = append(conds, under("tags.name", f, &args))
+	}
+	cond := "tags.uid = $1 AND ("+strings.Join(conds, " OR ")+")"
+
+	return db.inTx(func(tx *Tx) error {
+		// documents to retag, by new tag, read at once: tags
+		// may be renamed to ones which are renamed themselves
+		// (eg. merging a and b/c into b)
+		docs := make(map[string][]int32)
+		found := make([]bool, len(from))
+		var ks []tagKey
+		rows, err := tx.Query(`SELECT tags.name, tagsdocs.iddoc
+			FROM tags LEFT JOIN tagsdocs ON tagsdocs.idtag = tags.id
+			WHERE `+cond, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name string
+			var id sql.NullInt32
+			if err := rows.Scan(&name, &id); err != nil {
+				rows.Close()
+				return err
+			}
+			ks = append(ks, tagKey{ uid, name })
+			if id.Valid {
+				n := mergedTag(name, from, to)
+				docs[n] = append(docs[n], id.Int32)
+				markUnder(found, name, from)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, ok := range found {
+			if !ok {
+				return ErrNotFound
+			}
 		}
+
+		// tagsdocs go with the tags
+		if _, err := tx.Exec(`DELETE FROM tags WHERE `+cond, args...); err != nil {
+			return err
+		}
+		if err := tx.invalidate(ks...); err != nil {
+			return err
+		}
+
+		for name, ids := range docs {
+			for _, id := range ids {
+				if err := tx.tagDoc(uid, id, name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (db *Database) DelTag(uid int32, name string) error {
+	// shared: only untag uid's documents
+	if isSystemTag(name) {
+		return affected(db.Exec(`DELETE FROM tagsdocs
+			WHERE idtag IN (SELECT id FROM tags WHERE uid = 0 AND name = $1)
+			AND iddoc IN (SELECT id FROM docs WHERE uid = $2)`, name, uid))
 	}
+
+	return db.inTx(func(tx *Tx) error {
+		// unused tags aren't found (cf. Store)
+		err := affected(tx.Exec(`DELETE FROM tags
+			WHERE uid = $1 AND name = $2
+			AND id IN (SELECT idtag FROM tagsdocs)`, uid, name))
+		if err != nil {
+			return err
+		}
+		return tx.invalidate(tagKey{ uid, name })
+	})
+}
+
+func (tx *Tx) delTags(id int32) error {
+	_, err := tx.Exec(`DELETE FROM tagsdocs WHERE iddoc = $1`, id)
+	return err
 }
 
-func (db *Database) UpdateDoc(d *Doc) {
-	old := db.GetDoc(d.Id)
-	a, b, n := make([]string, 3), make([]string, 3), 0
+func (db *Database) UpdateDoc(d *Doc) error {
+	if !validType(d.Type) {
+		return invalidType(d.Type)
+	}
+
+	return db.inTx(func(tx *Tx) error {
+		old, err := db.getDoc(tx, d.Id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if changed(&old, d) {
+			_, err = tx.Exec(`INSERT INTO revisions(iddoc, name, type, content, tags, created, saved)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`, old.Id, old.Name, old.Type, old.Content,
+				strings.Join(old.Tags, TagSep), old.Updated, now)
+			if err != nil {
+				return err
+			}
+		}
 
-	if old.Name != d.Name {
-		a[n], b[n], n = "name", q(d.Name), n+1
+		_, err = tx.Exec(`UPDATE docs SET name = $2, type = $3, content = $4,
+				updated = $5
+			WHERE docs.id = $1`, d.Id, d.Name, d.Type, d.Content, now)
+		if err != nil || len(d.Tags) == 0 {
+			return err
+		}
+
+		if err := tx.delTags(d.Id); err != nil {
+			return err
+		}
+		return tx.addTags(old.Uid, d.Id, d.Tags)
+	})
+}
+
+func (db *Database) AddDoc(d *Doc) (id int32, err error) {
+	if !validType(d.Type) {
+		return -1, invalidType(d.Type)
 	}
-	if old.Type != d.Type {
-		a[n], b[n], n = "type", q(d.Type), n+1
+
+	id = -1
+	err = db.inTx(func(tx *Tx) error {
+		now := time.Now().UTC()
+		err := tx.QueryRow(`INSERT INTO docs(name, type, content, uid, created, updated)
+			VALUES ($1, $2, $3, $4, $5, $5)
+			RETURNING id`, d.Name, d.Type, d.Content, d.Uid, now).Scan(&id)
+		if err != nil {
+			return err
+		}
+		return tx.addTags(d.Uid, id, d.Tags)
+	})
+	if err != nil {
+		id = -1
 	}
-	if old.Content != d.Content {
-		a[n], b[n], n = "content", q(d.Content), n+1
+
+	return
+}
+
+func (db *Database) GetRevisions(id int32) (rs []Revision, err error) {
+	rows, err := db.Query(`SELECT id, iddoc, name, type, content, tags, created, saved
+		FROM revisions WHERE iddoc = $1
+		ORDER BY id DESC`, id)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	if n > 0 {
-		as, bs := strings.Join(a[:n], ", "), strings.Join(b[:n], ", ")
-		_, err := db.Query(`UPDATE docs SET (`+as+`) = (`+bs+`)
-			WHERE docs.id = $1`, d.Id)
+	for rows.Next() {
+		r, err := scanRevision(rows)
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
+		rs = append(rs, r)
 	}
 
-	if len(d.Tags) > 0 {
-		db.DelTags(d.Id, old.Tags)
-		db.AddTags(d.Id, d.Tags)
+	return rs, rows.Err()
+}
+
+func (db *Database) GetRevision(rid int32) (Revision, error) {
+	return scanRevision(db.QueryRow(`SELECT id, iddoc, name, type, content, tags, created, saved
+		FROM revisions WHERE id = $1`, rid))
+}
+
+func scanRevision(row scanner) (r Revision, err error) {
+	var tags string
+	err = row.Scan(&r.Id, &r.Doc.Id, &r.Doc.Name, &r.Doc.Type, &r.Doc.Content,
+		&tags, &r.Doc.Updated, &r.Saved)
+	if tags != "" {
+		r.Doc.Tags = strings.Split(tags, TagSep)
 	}
+	return r, notFound(err)
 }
 
-func (db *Database) AddDoc(d *Doc) (id int32) {
-	id = -1
-	err := db.QueryRow(`INSERT INTO docs(name, type, content, uid)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id`, d.Name, d.Type, d.Content, d.Uid).Scan(&id)
+func (db *Database) DelDoc(id int32) error {
+	return affected(db.Exec(`UPDATE docs SET deleted = $2
+		WHERE id = $1 AND deleted IS NULL`, id, time.Now().UTC()))
+}
+
+func (db *Database) GetTrash(uid int32) (ts []Trashed, err error) {
+	rows, err := db.Query(`SELECT `+db.docCols()+`, docs.deleted FROM docs
+		WHERE docs.uid = $1 AND docs.deleted IS NOT NULL
+		ORDER BY docs.deleted DESC, docs.id`, uid)
 	if err != nil {
-		LogError(err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	if id != -1 {
-		db.AddTags(id, d.Tags)
+	for rows.Next() {
+		var t Trashed
+		if err := scanDoc(rows, &t.Doc, &t.Deleted); err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
 	}
 
-	return
+	return ts, rows.Err()
 }
 
-func (db *Database) DelDoc(id int32) {
-	if _, err := db.Query("DELETE FROM docs WHERE docs.id = $1", id); err != nil {
-		log.Println(err)
+// check that exactly one row was affected
+func affected(res sql.Result, err error) error {
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = ErrNotFound
+		}
 	}
+	return err
+}
+
+func (db *Database) RestoreDoc(id, uid int32) error {
+	return affected(db.Exec(`UPDATE docs SET deleted = NULL
+		WHERE id = $1 AND uid = $2 AND deleted IS NOT NULL`, id, uid))
+}
+
+func (db *Database) PurgeDoc(id, uid int32) error {
+	return affected(db.Exec(`DELETE FROM docs
+		WHERE id = $1 AND uid = $2 AND deleted IS NOT NULL`, id, uid))
+}
+
+func (db *Database) Expire(t time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM docs WHERE deleted < $1`, t.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 func mkan(b, n int) (res string) {
 	res = "("
 	for i := 0; i < n; i++ {
-		res += "'$"+strconv.Itoa(b+i)+"'"
+		res += "$"+strconv.Itoa(b+i)
 		if i < n-1 { res += "," }
 	}
 	res += ")"
 	return
 }
 
-// following advices from
-// http://tagging.pui.ch/post/37027745720/tags-database-schemas
-// upon filtering : fetch every item which contains all the mandatory
-// tag, fetch them and do additional filtering here and not with SQL.
-// XXX add a cache id<->tags to avoid request
-func (db *Database) GetDocs(uid int32, tags []string) (ds []Doc) {
-	var rows *sql.Rows
-	var err error
-
-	// select all docs from uid
-	if len(tags) == 0 {
-		rows, err = db.Query(`SELECT id FROM docs
-			WHERE uid = $1`, uid)
-	} else {
-		var stmt *sql.Stmt
-		stmt, err = db.Prepare(`SELECT docs.id
-				FROM
-					tags, tagsdocs, docs
-				WHERE
-					tagsdocs.idtag	= tags.id
-				AND	tagsdocs.iddoc	= docs.id
-				AND	(docs.uid		= $1
-				OR	tags.name = ':public')
-				AND tags.name IN `+mkan(3, len(tags))+`
-				GROUP BY docs.id
-				HAVING COUNT(docs.id) = $2`)
-
-		rows, err = stmt.Query(uid, len(tags), tags)
+// strargs converts strings to query arguments.
+func strargs(xs []string) []interface{} {
+	args := make([]interface{}, len(xs))
+	for i, x := range xs {
+		args[i] = x
+	}
+	return args
+}
+
+// arg adds v to args; returns its placeholder.
+func arg(args *[]interface{}, v interface{}) string {
+	*args = append(*args, v)
+	return "$"+strconv.Itoa(len(*args))
+}
+
+// under compiles tagUnder(col, name).
+func under(col, name string, args *[]interface{}) string {
+	eq := col+" = "+arg(args, name)
+	if !tagBranch(name) {
+		return eq
+	}
+	p := name+TagPathSep
+	n := utf8.RuneCountInString(p)
+	return "("+eq+" OR (substr("+col+", 1, "+arg(args, n)+") = "+arg(args, p)+
+		" AND ltrim(substr("+col+", "+arg(args, n+1)+"), "+arg(args, TagPathSep)+") <> ''))"
+}
+
+// where compiles e to a condition on docs, adding parameters to args.
+func (db *Database) where(e Expr, args *[]interface{}) string {
+	switch e := e.(type) {
+	case TagExpr:
+		return `docs.id IN (SELECT tagsdocs.iddoc
+				FROM tagsdocs, tags
+				WHERE tagsdocs.idtag = tags.id
+				AND `+under("tags.name", string(e), args)+`)`
+	case TextExpr:
+		return db.dialect.text(words(string(e)), args)
+	case DateExpr:
+		col, op := "docs.created", " >= "
+		if e.Updated {
+			col = "docs.updated"
+		}
+		if e.Before {
+			op = " < "
+		}
+		return col+op+arg(args, e.T)
+	case *AndExpr:
+		return "("+db.where(e.X, args)+" AND "+db.where(e.Y, args)+")"
+	case *OrExpr:
+		return "("+db.where(e.X, args)+" OR "+db.where(e.Y, args)+")"
+	case *NotExpr:
+		return "NOT "+db.where(e.X, args)
+	}
+	panic("unknown expression")
+}
+
+// Without query, fetch all uid's documents; otherwise, fetch
+// documents matching q, readable by uid: documents are readable
+// by their owner, or by anyone if tagged :public. Documents are
+// sorted and paginated according to p (nil for all, default
+// order), whose Next is updated.
+func (db *Database) GetDocs(uid int32, q Expr, p *Page) (ds []Doc, err error) {
+	args := []interface{}{ uid }
+
+	cond := "docs.deleted IS NULL AND docs.uid = $1"
+	if q != nil {
+		cond = `docs.deleted IS NULL
+			AND (docs.uid = $1 OR `+db.where(TagExpr(":public"), &args)+`)
+			AND `+db.where(q, &args)
+	}
+
+	// sort key, selected after the document
+	var name string
+	var rank float64
+	var date time.Time
+	var dest []interface{}
+
+	by, desc := p.order(q)
+	key, from := "docs.id", "docs"
+	switch by {
+	case "name":
+		key, dest = "lower(coalesce(docs.name, ''))", append(dest, &name)
+	case "relevance":
+		var join string
+		join, key = db.dialect.rank(Terms(q), &args)
+		from, dest = from+" "+join, append(dest, &rank)
+	case "created", "updated":
+		key, dest = "docs."+by, append(dest, &date)
+	}
+
+	cmp, dir := ">", " ASC"
+	if desc {
+		cmp, dir = "<", " DESC"
+	}
+
+	if c := p.cursor(); c != nil {
+		var k interface{}
+		switch by {
+		case "name":
+			k = c.Name
+		case "relevance":
+			k = c.Rank
+		case "created", "updated":
+			k = c.time()
+		}
+		id := arg(&args, c.Id)
+		if k == nil {
+			cond += " AND docs.id "+cmp+" "+id
+		} else {
+			k := arg(&args, k)
+			cond += " AND ("+key+" "+cmp+" "+k+" OR ("+key+" = "+k+
+				" AND docs.id "+cmp+" "+id+"))"
+		}
+	}
+
+	order := "docs.id"+dir
+	if key != "docs.id" {
+		order = key+dir+", "+order
 	}
 
+	limit := ""
+	if p != nil && p.Limit > 0 {
+		limit = " LIMIT "+arg(&args, p.Limit+1)
+	}
+
+	cols := db.docCols()
+	if len(dest) > 0 {
+		cols += ", "+key
+	}
+
+	rows, err := db.Query(`SELECT `+cols+` FROM `+from+`
+		WHERE `+cond+`
+		ORDER BY `+order+limit, args...)
 	if err != nil {
-		LogError(err)
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
+	var c cursor
+	n := 0
 	for rows.Next() {
-		var id int32
-		rows.Scan(&id)
-		// XXX allows deeper filtering here.
-		ds = append(ds, db.GetDoc(id))
+		var d Doc
+		if err := scanDoc(rows, &d, dest...); err != nil {
+			return nil, err
+		}
+		if n++; p != nil && p.Limit > 0 && n > p.Limit {
+			break
+		}
+		c = cursor{ d.Id, name, rank, 0 }
+		if by == "created" || by == "updated" {
+			c.Time = date.UnixNano()
+		}
+		ds = append(ds, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if p != nil {
+		p.next(n, &c)
 	}
 
 	return
 }
 
+func (db *Database) AddToken(t *Token, hash string) (id int32, err error) {
+	err = db.QueryRow(`INSERT INTO tokens(uid, name, hash, scope)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`, t.Uid, t.Name, hash, t.Scope).Scan(&id)
+	return
+}
+
+func (db *Database) GetToken(hash string) (t Token, err error) {
+	err = db.QueryRow(`SELECT id, uid, name, scope, created FROM tokens
+		WHERE hash = $1`, hash).Scan(&t.Id, &t.Uid, &t.Name, &t.Scope, &t.Created)
+	return t, notFound(err)
+}
+
+func (db *Database) GetTokens(uid int32) (ts []Token, err error) {
+	rows, err := db.Query(`SELECT id, uid, name, scope, created FROM tokens
+		WHERE uid = $1
+		ORDER BY id`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Token
+		if err := rows.Scan(&t.Id, &t.Uid, &t.Name, &t.Scope, &t.Created); err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+
+	return ts, rows.Err()
+}
+
+func (db *Database) DelToken(id, uid int32) error {
+	return affected(db.Exec(`DELETE FROM tokens WHERE id = $1 AND uid = $2`, id, uid))
+}
+
+func (db *Database) AddUser(name, hash string) (id int32, err error) {
+	err = db.QueryRow(`INSERT INTO users(name, hash)
+		VALUES ($1, $2)
+		RETURNING id`, name, hash).Scan(&id)
+	return
+}
+
+func (db *Database) GetUser(name string) (u User, err error) {
+	err = db.QueryRow(`SELECT id, name, hash FROM users
+		WHERE name = $1`, name).Scan(&u.Id, &u.Name, &u.Hash)
+	return u, notFound(err)
+}
+
+func (db *Database) AddLogin(uid int32, hash string) error {
+	_, err := db.Exec(`INSERT INTO logins(hash, uid) VALUES ($1, $2)`, hash, uid)
+	return err
+}
+
+func (db *Database) GetLogin(hash string) (uid int32, err error) {
+	err = db.QueryRow(`SELECT uid FROM logins WHERE hash = $1`, hash).Scan(&uid)
+	return uid, notFound(err)
+}
+
+func (db *Database) DelLogin(hash string) error {
+	return affected(db.Exec(`DELETE FROM logins WHERE hash = $1`, hash))
+}
+
+func (db *Database) GetPrefs(uid int32) (p Prefs, err error) {
+	var tags string
+	err = db.QueryRow(`SELECT tags, search, pagesize, public, format
+		FROM prefs WHERE uid = $1`, uid).Scan(&tags, &p.Search,
+		&p.PageSize, &p.Public, &p.Format)
+	if err == sql.ErrNoRows {
+		return Prefs{}, nil
+	}
+	if tags != "" {
+		p.Tags = strings.Split(tags, TagSep)
+	}
+	return
+}
+
+func (db *Database) SetPrefs(uid int32, p *Prefs) error {
+	_, err := db.Exec(`INSERT INTO prefs(uid, tags, search, pagesize, public, format)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (uid) DO UPDATE SET
+			tags = excluded.tags, search = excluded.search,
+			pagesize = excluded.pagesize, public = excluded.public,
+			format = excluded.format`,
+		uid, strings.Join(cleanTags(p.Tags), TagSep), p.Search,
+		p.PageSize, p.Public, p.Format)
+	return err
+}
+
+func (db *Database) AddSession(s *Session) error {
+	_, err := db.Exec(`INSERT INTO sessions(id, uid, token, agent, addr, created, seen)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		s.Id, s.Uid, s.Token, s.Agent, s.Addr, s.Created.UTC(), s.Seen.UTC())
+	return err
+}
+
+func (db *Database) GetSession(id string) (s Session, err error) {
+	err = db.QueryRow(`SELECT id, uid, token, agent, addr, created, seen
+		FROM sessions WHERE id = $1`, id).Scan(&s.Id, &s.Uid, &s.Token,
+		&s.Agent, &s.Addr, &s.Created, &s.Seen)
+	return s, notFound(err)
+}
+
+func (db *Database) UpdateSession(s *Session) error {
+	return affected(db.Exec(`UPDATE sessions SET token = $2, seen = $3
+		WHERE id = $1`, s.Id, s.Token, s.Seen.UTC()))
+}
+
+func (db *Database) GetSessions(uid int32) (ss []Session, err error) {
+	rows, err := db.Query(`SELECT id, uid, token, agent, addr, created, seen
+		FROM sessions WHERE uid = $1
+		ORDER BY seen DESC`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.Id, &s.Uid, &s.Token, &s.Agent, &s.Addr, &s.Created, &s.Seen)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+
+	return ss, rows.Err()
+}
+
+func (db *Database) DelSession(id string, uid int32) error {
+	return affected(db.Exec(`DELETE FROM sessions WHERE id = $1 AND uid = $2`, id, uid))
+}
+
+func (db *Database) ExpireSessions(t time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM sessions WHERE seen < $1`, t.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
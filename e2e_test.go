@@ -0,0 +1,219 @@
+package main
+
+// End-to-end tests: the whole application, authenticating
+// against FakeAuth.
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type browser struct {
+	*testing.T
+	*http.Client
+	base	string
+	csrf	string		// last seen CSRF token
+}
+
+var csrfre = regexp.MustCompile(`name="csrf" value="([^"]*)"`)
+
+func newBrowser(t *testing.T, base string) *browser {
+	jar, _ := cookiejar.New(nil)
+	return &browser{ t, &http.Client{
+		Jar	:	jar,
+		// inspect redirections
+		CheckRedirect : func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, base, "" }
+}
+
+// request path, posting the last seen CSRF token with form
+// unless it has one; returns the status code, the redirection
+// if any, and the body
+func (b *browser) do(method, path string, form url.Values) (int, string, string) {
+	var resp *http.Response
+	var err error
+
+	if method == "GET" {
+		resp, err = b.Get(b.base+path)
+	} else {
+		if _, ok := form["csrf"]; !ok && b.csrf != "" {
+			form.Set("csrf", b.csrf)
+		}
+		resp, err = b.PostForm(b.base+path, form)
+	}
+	if err != nil {
+		b.Fatal(method, path, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if m := csrfre.FindStringSubmatch(string(body)); m != nil {
+		b.csrf = m[1]
+	}
+	return resp.StatusCode, resp.Header.Get("Location"), string(body)
+}
+
+// get and clear the tags-info cookie
+func (b *browser) info() string {
+	u, _ := url.Parse(b.base)
+	for _, c := range b.Jar.Cookies(u) {
+		if c.Name == "tags-info" {
+			b.Jar.SetCookies(u, []*http.Cookie{{ Name : "tags-info", Path : "/", MaxAge : -1 }})
+			return strings.Replace(c.Value, "_", " ", -1)
+		}
+	}
+	return ""
+}
+
+func (b *browser) cookies() []*http.Cookie {
+	u, _ := url.Parse(b.base)
+	return b.Jar.Cookies(u)
+}
+
+func TestEndToEnd(t *testing.T) {
+	fake := NewFakeAuth("testkey")
+	as := httptest.NewServer(fake)
+	defer as.Close()
+
+	var err error
+	if auth, err = NewRemoteAuth(as.URL+"/", "testkey", ""); err != nil {
+		t.Fatal(err)
+	}
+	db = NewMemStore()
+	loginForm = template.Must(template.ParseFiles(auth.Form()))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", tags)
+	mux.HandleFunc(apiprefix, api)
+	app := httptest.NewServer(mux)
+	defer app.Close()
+
+	uid := fake.AddUser("alice@example.com")
+	b := newBrowser(t, app.URL)
+
+	// not logged in yet
+	if code, loc, _ := b.do("GET", "/user/", nil); code != http.StatusFound || loc != "/" {
+		t.Fatal("Anonymous access:", code, loc)
+	}
+	b.info()
+
+	// so is logging in from other sites
+	for _, c := range []string{"", "forged"} {
+		code, _, _ := b.do("POST", "/login/", url.Values{ "login" : {"alice@example.com"}, "csrf" : {c} })
+		if code != http.StatusForbidden || fake.Sent["alice@example.com"] != "" {
+			t.Error("Forged login accepted:", c, code)
+		}
+	}
+	if code, _, _ := b.do("GET", "/login/", nil); code != http.StatusOK || b.csrf == "" {
+		t.Fatal("No CSRF token before login:", code)
+	}
+	pre := b.csrf
+
+	if _, loc, _ := b.do("POST", "/login/", url.Values{ "login" : {"mallory"} }); loc != "/login" ||
+	   b.info() != "Error: "+ErrBadLogin.Error() {
+		t.Error("Unknown user logged in")
+	}
+
+	// ask for a token
+	b.do("POST", "/login/", url.Values{ "login" : {"alice@example.com"} })
+	if b.info() != ErrNewToken.Error() || fake.Sent["alice@example.com"] == "" {
+		t.Fatal("No new token")
+	}
+
+	_, loc, _ := b.do("POST", "/login/", url.Values{ "login" : {fake.Sent["alice@example.com"]} })
+	if loc != "/user/" {
+		t.Fatal("Cannot log in:", b.info())
+	}
+	// fresh token once logged in
+	if b.do("GET", "/user/", nil); b.csrf == pre {
+		t.Error("Pre-session CSRF token kept")
+	}
+
+	if code, _, body := b.do("GET", "/user/", nil); code != http.StatusOK ||
+	   !strings.Contains(body, "Logout") {
+		t.Fatal("Cannot access user page:", code)
+	}
+
+	// cross-site posts are rejected
+	for _, c := range []string{"", "forged"} {
+		code, _, _ := b.do("POST", "/add/", url.Values{
+			"name"		:	{"Forged"},
+			"tags"		:	{"forged"},
+			"content"	:	{"forged"},
+			"csrf"		:	{c},
+		})
+		if code != http.StatusForbidden || len(docsOf(t, db, uid, nil, nil)) != 0 {
+			t.Error("Forged post accepted:", c, code)
+		}
+	}
+
+	// as are cookie-authenticated API writes
+	req, _ := http.NewRequest("POST", app.URL+apiprefix+"docs",
+		strings.NewReader(`{"Name":"Forged","Tags":["forged"],"Content":"forged"}`))
+	if resp, err := b.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Forged API post accepted:", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	b.do("POST", "/add/", url.Values{
+		"name"		:	{"Slackware"},
+		"tags"		:	{"bookmarks linux"},
+		"content"	:	{"http://www.slackware.com/"},
+	})
+	ds := docsOf(t, db, uid, nil, nil)
+	if len(ds) != 1 || ds[0].Uid != uid {
+		t.Fatal("Document not added:", ds, b.info())
+	}
+	id := strconv.Itoa(int(ds[0].Id))
+
+	if _, _, body := b.do("POST", "/user/", url.Values{ "search" : {"linux"} }); !strings.Contains(body, "slackware.com") {
+		t.Error("Document not found")
+	}
+
+	b.do("POST", "/edit/", url.Values{
+		"id"		:	{id},
+		"action"	:	{"edit"},
+		"name"		:	{"Slackware Linux"},
+		"tags"		:	{"linux"},
+		"content"	:	{"http://www.slackware.com/"},
+	})
+	if d := docOf(db, ds[0].Id); d.Name != "Slackware Linux" {
+		t.Error("Document not updated:", d, b.info())
+	}
+
+	// tokens are chained: an old cookie is worthless
+	old := b.cookies()
+	b.do("GET", "/user/", nil)
+	replay := newBrowser(t, app.URL)
+	u, _ := url.Parse(app.URL)
+	replay.Jar.SetCookies(u, old)
+	if _, loc, _ := replay.do("GET", "/user/", nil); loc != "/" {
+		t.Error("Replayed cookie accepted")
+	}
+
+	b.do("POST", "/edit/", url.Values{ "id" : {id}, "action" : {"delete"} })
+	if docOf(db, ds[0].Id).Id != -1 {
+		t.Error("Document not deleted")
+	}
+
+	if _, loc, _ := b.do("GET", "/logout", nil); loc != "/" {
+		t.Error("Bad logout redirection:", loc)
+	}
+	if len(fake.tokens) != 0 {
+		t.Error("Token still valid after logout")
+	}
+	if _, loc, _ := b.do("GET", "/user/", nil); loc != "/" {
+		t.Error("Access after logout")
+	}
+}
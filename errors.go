@@ -0,0 +1,58 @@
+package main
+
+// Errors returned by Stores, which may wrap them for details
+// (compare with errors.Is), and their HTTP counterparts.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrNotFound		= errors.New("Not found")
+	ErrInvalidType	= errors.New("Invalid type")
+	ErrForbidden	= errors.New("You don't own this.")
+	ErrNoTags		= errors.New("At least one tag is required")
+	ErrBadTag		= errors.New("Invalid tag name")
+	ErrSystemTag	= errors.New("System tags (:tag) can't be renamed")
+	ErrTagLoop		= errors.New("Can't move a tag under itself")
+)
+
+// storage failures are reported as such, without details
+var errInternal = errors.New("Internal error, please retry later")
+
+func invalidType(t string) error {
+	return fmt.Errorf("%w: %q", ErrInvalidType, t)
+}
+
+// database/sql's "no rows" to ErrNotFound
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// httpError maps err to an HTTP status and a message fit for
+// users; unexpected errors are logged.
+func httpError(err error) (int, error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, err
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrSystemTag):
+		return http.StatusForbidden, err
+	case errors.Is(err, ErrInvalidType), errors.Is(err, ErrNoTags),
+		 errors.Is(err, ErrBadTag), errors.Is(err, ErrTagLoop):
+		return http.StatusBadRequest, err
+	}
+	LogError(err)
+	return http.StatusInternalServerError, errInternal
+}
+
+// userError is err's message for HTML pages.
+func userError(err error) error {
+	_, err = httpError(err)
+	return err
+}
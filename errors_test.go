@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPError(t *testing.T) {
+	for _, test := range []struct {
+		err		error
+		code	int
+		msg		error
+	}{
+		{ ErrNotFound, http.StatusNotFound, ErrNotFound },
+		{ ErrForbidden, http.StatusForbidden, ErrForbidden },
+		{ ErrNoTags, http.StatusBadRequest, ErrNoTags },
+		{ invalidType("exe"), http.StatusBadRequest, nil },
+		{ fmt.Errorf("restore: %w", ErrNotFound), http.StatusNotFound, nil },
+		{ errors.New("connection refused"), http.StatusInternalServerError, errInternal },
+	} {
+		code, msg := httpError(test.err)
+		if code != test.code || test.msg != nil && msg != test.msg || msg.Error() == "" {
+			t.Error("Bad mapping:", test.err, code, msg)
+		}
+	}
+
+	if _, msg := httpError(invalidType("exe")); msg.Error() != `Invalid type: "exe"` {
+		t.Error("Bad message:", msg)
+	}
+}
+
+// storage failures aren't empty results
+func TestStoreDown(t *testing.T) {
+	down, err := OpenSQLite(filepath.Join(t.TempDir(), "tags.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	db = down
+
+	var e apiError
+	for _, path := range []string{ "docs", "docs?q=x", "tags" } {
+		if code := call(t, 1, "GET", path, "", &e); code != http.StatusInternalServerError || e.Error != errInternal.Error() {
+			t.Error("Failure not reported:", path, code, e)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	trash(w, httptest.NewRequest("GET", "/trash/", nil), 1)
+	if body := w.Body.String(); !strings.Contains(body, errInternal.Error()) || strings.Contains(body, "closed") {
+		t.Error("Bad trash page:", body)
+	}
+}
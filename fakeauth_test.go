@@ -0,0 +1,92 @@
+package main
+
+// In-process stand-in for the remote auth server (cf. remote.go):
+// users are created with AddUser; tokens "sent" to users are
+// kept in Sent.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type FakeAuth struct {
+	sync.Mutex
+	key		string
+	users	map[string]int32	// login (name, email) -> uid
+	tokens	map[string]int32	// valid tokens -> uid
+	Sent	map[string]string	// login -> last token sent
+}
+
+func NewFakeAuth(key string) *FakeAuth {
+	return &FakeAuth{
+		key		:	key,
+		users	:	make(map[string]int32),
+		tokens	:	make(map[string]int32),
+		Sent	:	make(map[string]string),
+	}
+}
+
+func (a *FakeAuth) AddUser(login string) int32 {
+	a.Lock()
+	defer a.Unlock()
+
+	a.users[login] = int32(len(a.users)+1)
+	return a.users[login]
+}
+
+// new token for uid; a is locked
+func (a *FakeAuth) newToken(uid int32) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	a.tokens[token] = uid
+	return token
+}
+
+func (a *FakeAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	defer a.Unlock()
+
+	if r.FormValue("key") != a.key {
+		http.Error(w, "bad key", http.StatusForbidden)
+		return
+	}
+
+	token := r.FormValue("token")
+	uid, valid := a.tokens[token]
+
+	switch strings.TrimLeft(r.URL.Path, "/") {
+	case "api/login":
+		login := r.FormValue("login")
+		if _, ok := a.tokens[login]; ok {
+			w.Write([]byte("ok"))
+		} else if uid, ok := a.users[login]; ok {
+			a.Sent[login] = a.newToken(uid)
+			w.Write([]byte("new"))
+		} else {
+			ko(w)
+		}
+	case "api/chain":
+		if !valid {
+			ko(w)
+			return
+		}
+		delete(a.tokens, token)
+		w.Write([]byte(a.newToken(uid)))
+	case "api/info":
+		if !valid {
+			ko(w)
+			return
+		}
+		w.Write([]byte(strconv.Itoa(int(uid))+"\n"))
+	case "api/logout":
+		delete(a.tokens, token)
+		w.Write([]byte("ok"))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+// Documents' revision history: UpdateDoc saves the previous
+// version of a document; the history page shows the changes
+// made by each version, and restores past ones.
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var htmpl = template.Must(
+	template.New("history.html").Funcs(template.FuncMap{
+		"GetTags": func(tags []string) string {
+			return strings.Join(tags, ", ")
+		},
+	}).ParseFiles("templates/history.html"))
+
+// sorted copy of tags, without separators
+func sortedTags(tags []string) []string {
+	ts := cleanTags(tags)
+	sort.Strings(ts)
+	return ts
+}
+
+// does updating a with b change anything? (b's
+// tags are ignored if empty, cf. UpdateDoc)
+func changed(a, b *Doc) bool {
+	if a.Name != b.Name || a.Type != b.Type || a.Content != b.Content {
+		return true
+	}
+	return len(b.Tags) > 0 &&
+		strings.Join(sortedTags(a.Tags), TagSep) != strings.Join(sortedTags(b.Tags), TagSep)
+}
+
+// line of a diff; Op is "+" (added), "-" (removed) or " "
+type DiffLine struct {
+	Op		string
+	Text	string
+}
+
+// diff compares a and b line by line (longest common
+// subsequence); returns nil if they are equal.
+func diff(a, b string) (ds []DiffLine) {
+	if a == b {
+		return nil
+	}
+	xs, ys := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// lcs[i][j]: length of the LCS of xs[i:] and ys[j:]
+	lcs := make([][]int, len(xs)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(ys)+1)
+	}
+	for i := len(xs)-1; i >= 0; i-- {
+		for j := len(ys)-1; j >= 0; j-- {
+			if xs[i] == ys[j] {
+				lcs[i][j] = lcs[i+1][j+1]+1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(xs) || j < len(ys) {
+		switch {
+		case i < len(xs) && j < len(ys) && xs[i] == ys[j]:
+			ds, i, j = append(ds, DiffLine{ " ", xs[i] }), i+1, j+1
+		case j < len(ys) && (i == len(xs) || lcs[i][j+1] >= lcs[i+1][j]):
+			ds, j = append(ds, DiffLine{ "+", ys[j] }), j+1
+		default:
+			ds, i = append(ds, DiffLine{ "-", xs[i] }), i+1
+		}
+	}
+
+	return
+}
+
+// changes made by a version of a document
+type Change struct {
+	Rev		int32		// revision id, 0 for the current version
+	Doc		Doc
+	Name	bool		// name changed
+	Type	bool
+	Tags	bool
+	Diff	[]DiffLine	// content changes
+}
+
+// changes made by each version of ds (newest first)
+func changes(ds []Doc, rids []int32) (cs []Change) {
+	for i, d := range ds {
+		c := Change{ Rev : rids[i], Doc : d }
+		if i+1 < len(ds) {
+			old := &ds[i+1]
+			c.Name, c.Type = old.Name != d.Name, old.Type != d.Type
+			c.Tags = strings.Join(sortedTags(old.Tags), TagSep) !=
+				strings.Join(sortedTags(d.Tags), TagSep)
+			c.Diff = diff(old.Content, d.Content)
+		}
+		cs = append(cs, c)
+	}
+	return
+}
+
+// list one's document versions, restore one
+func history(w http.ResponseWriter, r *http.Request, uid int32) {
+	i, _ := strconv.ParseInt(r.FormValue("id"), 10, 32)
+	id := int32(i)
+
+	if err := db.CheckOwner(id, uid); err != nil {
+		SetError(w, userError(err))
+		http.Redirect(w, r, "/user/", http.StatusFound)
+		return
+	}
+
+	var err error
+
+	if r.Method == "POST" && r.FormValue("action") == "restore" {
+		var rev Revision
+		i, _ := strconv.ParseInt(r.FormValue("rev"), 10, 32)
+		rev, err = db.GetRevision(int32(i))
+		switch {
+		case errors.Is(err, ErrNotFound), err == nil && rev.Doc.Id != id:
+			err = errors.New("No such revision")
+		case err == nil:
+			d := rev.Doc
+			d.Uid = uid
+			if err = db.UpdateDoc(&d); err != nil {
+				err = userError(err)
+			}
+		default:
+			err = userError(err)
+		}
+	}
+
+	d := struct {
+		Id			int32
+		Changes		[]Change
+		Error		error
+		Csrf		string
+	}{ Id : id, Error : err, Csrf : csrfToken(r) }
+
+	rs, err := db.GetRevisions(id)
+	if err != nil {
+		d.Error = userError(err)
+	}
+
+	cur, err := db.GetDoc(id)
+	if err != nil {
+		d.Error = userError(err)
+	}
+
+	ds, rids := []Doc{ cur }, []int32{ 0 }
+	for _, rev := range rs {
+		ds, rids = append(ds, rev.Doc), append(rids, rev.Id)
+	}
+	d.Changes = changes(ds, rids)
+
+	if err := htmpl.Execute(w, &d); err != nil {
+		LogHttp(w, err)
+	}
+}
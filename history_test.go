@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, test := range []struct {
+		a, b	string
+		diff	string
+	}{
+		{ "a", "a", "" },
+		{ "a\nb\nc", "a\nc", " a|-b| c|" },
+		{ "a\nc", "a\nb\nc", " a|+b| c|" },
+		{ "a\nb", "c", "+c|-a|-b|" },
+		{ "", "a", "+a|-|" },
+	} {
+		s := ""
+		for _, l := range diff(test.a, test.b) {
+			s += l.Op+l.Text+"|"
+		}
+		if s != test.diff {
+			t.Errorf("Bad diff of %q, %q: %q, expected %q", test.a, test.b, s, test.diff)
+		}
+	}
+}
+
+func TestHistoryPage(t *testing.T) {
+	db = NewMemStore()
+
+	id := mustAdd(t, db, &Doc{ Id : -1, Name : "v1", Type : "text",
+		Content : "first line", Uid : 1, Tags : []string{"a"} })
+	sid := strconv.Itoa(int(id))
+	post(edit, 1, url.Values{
+		"id"		:	{sid},
+		"action"	:	{"edit"},
+		"name"		:	{"v2"},
+		"tags"		:	{"a b"},
+		"content"	:	{"first line\nsecond line"},
+	})
+
+	w := post(history, 1, url.Values{ "id" : {sid} })
+	if body := w.Body.String(); !strings.Contains(body, `diff-add">&#43; second line`) ||
+	   !strings.Contains(body, "Name: v1") {
+		t.Fatal("Bad history:", body)
+	}
+
+	if w := post(history, 2, url.Values{ "id" : {sid} }); !strings.HasPrefix(infoCookie(w), "Error:") {
+		t.Error("Foreign history displayed")
+	}
+
+	rs, _ := db.GetRevisions(id)
+	post(history, 1, url.Values{ "id" : {sid}, "action" : {"restore"}, "rev" : {strconv.Itoa(int(rs[0].Id))} })
+	if d := docOf(db, id); d.Name != "v1" || d.Content != "first line" || len(d.Tags) != 1 {
+		t.Error("Revision not restored:", d)
+	}
+	if rs, _ := db.GetRevisions(id); len(rs) != 2 || rs[0].Doc.Name != "v2" {
+		t.Error("Restore not undoable:", rs)
+	}
+
+	// revisions of other documents can't be restored
+	other := mustAdd(t, db, &Doc{ Id : -1, Name : "x", Type : "text", Content : "x", Uid : 1, Tags : []string{"x"} })
+	w = post(history, 1, url.Values{ "id" : {strconv.Itoa(int(other))}, "action" : {"restore"},
+		"rev" : {strconv.Itoa(int(rs[0].Id))} })
+	if !strings.Contains(w.Body.String(), "No such revision") || docOf(db, other).Name != "x" {
+		t.Error("Foreign revision restored")
+	}
+}
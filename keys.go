@@ -0,0 +1,122 @@
+package main
+
+// Cookie keys, kept in a file (-keys) so that cookies survive
+// restarts. One hash/block key pair per line, hex-encoded, the
+// current pair first: previous pairs only decode cookies, so
+// that keys can be rotated without logging everyone out.
+//	tags keys gen		create a key file
+//	tags keys rotate [N]	add a new pair, keep N pairs (default 2)
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// generate a hash/block key pair
+func genPair() [][]byte {
+	return [][]byte{
+		securecookie.GenerateRandomKey(32),
+		securecookie.GenerateRandomKey(32),
+	}
+}
+
+func readKeys(path string) (pairs [][]byte, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for n, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		xs := strings.Fields(line)
+		if len(xs) != 2 {
+			return nil, fmt.Errorf("%s:%d: expecting two keys", path, n+1)
+		}
+		for _, x := range xs {
+			k, err := hex.DecodeString(x)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n+1, err)
+			}
+			pairs = append(pairs, k)
+		}
+	}
+
+	if len(pairs) == 0 {
+		return nil, errors.New(path+": no keys")
+	}
+
+	return pairs, nil
+}
+
+func writeKeys(path string, pairs [][]byte) error {
+	s := "# cookie keys (hash, block); current first\n"
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s += hex.EncodeToString(pairs[i])+" "+hex.EncodeToString(pairs[i+1])+"\n"
+	}
+
+	// write then rename, not to lose keys on failure
+	tmp := path+".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(s), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadKeys sets the cookie codecs from file path, which
+// is created if it doesn't exist.
+func loadKeys(path string) error {
+	pairs, err := readKeys(path)
+	if os.IsNotExist(err) {
+		pairs = genPair()
+		err = writeKeys(path, pairs)
+	}
+	if err != nil {
+		return err
+	}
+
+	codecs = securecookie.CodecsFromPairs(pairs...)
+	return nil
+}
+
+// keys [gen | rotate [N]]
+func keys(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: keys [gen | rotate [N]]")
+	}
+
+	switch args[0] {
+	case "gen":
+		if _, err := os.Stat(*keyfile); err == nil {
+			return errors.New(*keyfile+" exists; use keys rotate")
+		}
+		return writeKeys(*keyfile, genPair())
+	case "rotate":
+		n := 2
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				return errors.New("bad number of pairs: "+args[1])
+			}
+		}
+		pairs, err := readKeys(*keyfile)
+		if err != nil {
+			return err
+		}
+		pairs = append(genPair(), pairs...)
+		if len(pairs) > 2*n {
+			pairs = pairs[:2*n]
+		}
+		return writeKeys(*keyfile, pairs)
+	}
+
+	return errors.New("usage: keys [gen | rotate [N]]")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// cookies survive restarts and key rotations
+func TestKeys(t *testing.T) {
+	*keyfile = filepath.Join(t.TempDir(), "keys")
+	defer func() { *keyfile = "cookie-keys" }()
+
+	// created on first load
+	if err := loadKeys(*keyfile); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(*keyfile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatal("Bad key file:", err)
+	}
+	if keys([]string{"gen"}) == nil {
+		t.Error("Existing key file overwritten")
+	}
+
+	w := httptest.NewRecorder()
+	if err := setToken(w, httptest.NewRequest("GET", "/", nil), "token", 42); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+
+	check := func(ok bool) {
+		if err := loadKeys(*keyfile); err != nil {
+			t.Fatal(err)
+		}
+		token, uid, err := getToken(r)
+		if ok && (err != nil || token != "token" || uid != 42) {
+			t.Error("Cookie not decoded:", token, uid, err)
+		}
+		if !ok && err == nil {
+			t.Error("Cookie decoded with a retired key")
+		}
+	}
+
+	// "restart"
+	check(true)
+
+	if err := keys([]string{"rotate"}); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+
+	// the original pair is dropped
+	if err := keys([]string{"rotate"}); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+
+	if keys([]string{"rotate", "0"}) == nil || keys([]string{"nope"}) == nil {
+		t.Error("Bad arguments accepted")
+	}
+}
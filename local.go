@@ -0,0 +1,80 @@
+package main
+
+// Local authentication: accounts (name, bcrypt'd password)
+// are kept in the Store, so that no auth server is needed.
+// Each login gets a random token, valid until logout; only its
+// hash is stored (cf. tokens.go).
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+)
+
+// minimum password length
+const minpasswd = 8
+
+type LocalAuth struct{}
+
+func (a *LocalAuth) Form() string {
+	return "templates/login-local.html"
+}
+
+func (a *LocalAuth) Login(r *http.Request) (string, int32, error) {
+	u, err := db.GetUser(r.FormValue("login"))
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(u.Hash),
+			[]byte(r.FormValue("password")))
+	}
+	if err != nil {
+		return "", 0, ErrBadLogin
+	}
+
+	token, hash, err := newToken()
+	if err == nil {
+		err = db.AddLogin(u.Id, hash)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return token, u.Id, nil
+}
+
+func (a *LocalAuth) Chain(token string) (string, error) {
+	if _, err := db.GetLogin(hashToken(token)); err != nil {
+		return "", errors.New("bad token")
+	}
+	return token, nil
+}
+
+func (a *LocalAuth) Logout(token string) {
+	if err := db.DelLogin(hashToken(token)); err != nil && err != ErrNotFound {
+		LogError(err)
+	}
+}
+
+func (a *LocalAuth) Register(r *http.Request) (int32, error) {
+	name := strings.TrimSpace(r.FormValue("login"))
+	passwd := r.FormValue("password")
+
+	switch {
+	case name == "":
+		return 0, errors.New("A name is required")
+	case len(passwd) < minpasswd:
+		return 0, errors.New("Password too short")
+	case passwd != r.FormValue("password2"):
+		return 0, errors.New("Passwords differ")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := db.GetUser(name); err == nil {
+		return 0, errors.New("Name already taken")
+	}
+
+	return db.AddUser(name, string(hash))
+}
@@ -8,11 +8,78 @@ package main
 // SELECT docs.id FROM tags, tagsdocs, docs WHERE tagsdocs.idtag = tags.id AND tagsdocs.iddoc = docs.id AND tags.name IN ('bookmarks', 'physics') GROUP BY docs.id HAVING COUNT(docs.id) = 2;
 import (
 	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-var testdb *Database
+// Backends the test suite runs against; a backend
+// which can't be opened (eg. no PostgreSQL running) is skipped.
+var backends = map[string]func(t testing.TB) (Store, error){
+	"postgres": func(t testing.TB) (Store, error) {
+		return OpenStore("postgres", pgdsn)
+	},
+	"sqlite": func(t testing.TB) (Store, error) {
+		return OpenStore("sqlite", filepath.Join(t.TempDir(), "tags.db"))
+	},
+	"memory": func(t testing.TB) (Store, error) {
+		return OpenStore("memory", "")
+	},
+}
+
+// run f once per available backend
+func forEachStore(t *testing.T, f func(*testing.T, Store)) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			s, err := open(t)
+			if err != nil {
+				t.Skip("backend unavailable:", err)
+			}
+			f(t, s)
+		})
+	}
+}
+
+// add d to st, failing t on error
+func mustAdd(t testing.TB, st Store, d *Doc) int32 {
+	id, err := st.AddDoc(d)
+	if err != nil {
+		t.Fatal("Cannot add document:", err)
+	}
+	return id
+}
+
+// documents readable by uid matching q, failing t on error
+func docsOf(t testing.TB, st Store, uid int32, q Expr, p *Page) []Doc {
+	ds, err := st.GetDocs(uid, q, p)
+	if err != nil {
+		t.Fatal("Cannot get documents:", err)
+	}
+	return ds
+}
+
+// uid's tags, failing t on error
+func tagsOf(t testing.TB, st Store, uid int32) []Tag {
+	ts, err := st.GetTags(uid)
+	if err != nil {
+		t.Fatal("Cannot get tags:", err)
+	}
+	return ts
+}
+
+// document id, Id -1 if it can't be fetched
+func docOf(st Store, id int32) Doc {
+	d, err := st.GetDoc(id)
+	if err != nil {
+		return Doc{ Id : -1 }
+	}
+	return d
+}
 
 type testdocs struct {
 	json		[]byte		// JSON-ified doc
@@ -121,38 +188,70 @@ var docs = []testdocs {
 	},
 }
 
-// XXX for now, we only support tag1 AND tag2 AND tag3, etc.
 type testqueries struct {
-	query		[]string	// list of tags
+	query		string		// search query, cf. query.go
 	results		[]string	// Name of the docs; unique in testdocs
 }
 
 var queries = []testqueries {
 	{
-		[]string{ "bookmarks" },
+		"bookmarks",
 		[]string{
 			"/r/physics", "/r/programming",
 			"Hacker News", "Slashdot", "Slackware",
 		},
 	},
 	{
-		[]string{ "physics" },
+		"physics",
 		[]string{ "The ArXiV","/r/physics","Slashdot" },
 	},
 	{
-		[]string{ "physics", "bookmarks" },
+		"physics bookmarks",
 		[]string{ "/r/physics", "Slashdot" },
 	},
+	{
+		"physics AND bookmarks",
+		[]string{ "/r/physics", "Slashdot" },
+	},
+	{
+		"papers OR linux",
+		[]string{ "The ArXiV", "Slackware" },
+	},
+	{
+		"bookmarks -/r/",
+		[]string{ "Hacker News", "Slashdot", "Slackware" },
+	},
+	{
+		"programming -/r/ (physics OR maths)",
+		[]string{ "Slashdot" },
+	},
+	{
+		"bookmarks AND NOT (programming OR linux)",
+		[]string{ "/r/physics" },
+	},
+	{
+		`"badtag"`,
+		[]string{ "bad tag" },
+	},
+	{
+		"text:arxiv OR linux",
+		[]string{ "The ArXiV", "Slackware" },
+	},
+	{
+		`text:"hacker NEWS" programming`,
+		[]string{ "Hacker News" },
+	},
+	{
+		"bookmarks -text:slackware -/r/",
+		[]string{ "Hacker News", "Slashdot" },
+	},
 }
 
 func TestDocs(t *testing.T) {
-	// Database Creation
-//	testdb = NewDB("test")
-	testdb = NewDB()
-	if testdb == nil {
-		t.Error("Database creation failure")
-	}
+	forEachStore(t, testDocs)
+}
 
+func testDocs(t *testing.T, testdb Store) {
 	var ids []int32
 
 	// Add every test documents
@@ -163,17 +262,16 @@ func TestDocs(t *testing.T) {
 			t.Log(string(doc.json))
 			t.Error("Cannot retrieve doc:", err)
 		}
-		id := testdb.AddDoc(&d)
-		if id != -1 && !doc.inserted ||
-		   id == -1 && doc.inserted {
-			t.Error("Wrong expectation about doc insertion")
+		id, err := testdb.AddDoc(&d)
+		if (err == nil) != doc.inserted || (id != -1) != doc.inserted {
+			t.Error("Wrong expectation about doc insertion:", err)
 		}
 
 		// Fetch previously added document
 		if id != -1 {
 			ids = append(ids, id)
 			d.Id = id
-			d2 := testdb.GetDoc(id)
+			d2 := docOf(testdb, id)
 			if d.Name != d2.Name {
 				t.Error("Bad name:", d.Name, d2.Name)
 			} else if d.Type != d2.Type {
@@ -199,11 +297,15 @@ func TestDocs(t *testing.T) {
 
 	// Launch every query
 	for _, query := range queries {
-		ds := testdb.GetDocs(1, query.query)
+		q, err := ParseQuery(query.query)
+		if err != nil {
+			t.Fatal(query.query, err)
+		}
+		ds := docsOf(t, testdb, 1, q, nil)
 		if len(ds) != len(query.results) {
 			t.Log(len(ds), ds)
 			t.Log(len(query.results), query.results)
-			t.Error("Wrong number of results")
+			t.Error("Wrong number of results:", query.query)
 		}
 		for _, d := range ds {
 			found := false
@@ -221,3 +323,835 @@ func TestDocs(t *testing.T) {
 	// Drop everything
 //	testdb.Query("DROP TABLE docs CASCADE; DROP TABLE tagsdocs CASCADE; DROP TABLE tags CASCADE; DROP TYPE dtype;")
 }
+
+func TestPublic(t *testing.T) {
+	forEachStore(t, testPublic)
+}
+
+// documents of other users are only visible when tagged :public
+func testPublic(t *testing.T, testdb Store) {
+	pub := mustAdd(t, testdb, &Doc{ Id : -1, Name : "public", Type : "text",
+		Content : "hello", Uid : 2, Tags : []string{":public", "pubtest"} })
+	priv := mustAdd(t, testdb, &Doc{ Id : -1, Name : "private", Type : "text",
+		Content : "hello", Uid : 2, Tags : []string{"pubtest"} })
+	if pub == -1 || priv == -1 {
+		t.Fatal("Cannot add documents")
+	}
+
+	found := false
+	for _, d := range docsOf(t, testdb, 1, TagExpr("pubtest"), nil) {
+		if d.Id == priv {
+			t.Error("Private document retrieved")
+		}
+		if d.Id == pub { found = true }
+	}
+	if !found {
+		t.Error("Public document not retrieved")
+	}
+
+	// without tags, only one's documents
+	for _, d := range docsOf(t, testdb, 1, nil, nil) {
+		if d.Uid != 1 {
+			t.Error("Foreign document retrieved:", d.Name)
+		}
+	}
+
+	if testdb.CheckOwner(pub, 2) != nil || testdb.CheckOwner(pub, 1) != ErrForbidden ||
+	   testdb.CheckOwner(priv+1000, 2) != ErrNotFound {
+		t.Error("Wrong ownership")
+	}
+
+	testdb.DelDoc(pub)
+	testdb.DelDoc(priv)
+	if _, err := testdb.GetDoc(pub); err != ErrNotFound {
+		t.Error("Document not deleted:", err)
+	}
+}
+
+// every migration must be reversible
+func TestMigrate(t *testing.T) {
+	db, err := openDB(sqlite, filepath.Join(t.TempDir(), "tags.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, v := range []int{ db.Latest(), 0, db.Latest() } {
+		if err := db.Migrate(v); err != nil {
+			t.Fatal(err)
+		}
+		if w, err := db.Version(); err != nil || w != v {
+			t.Error("Bad version:", w, v, err)
+		}
+	}
+
+	if db.Migrate(db.Latest()+1) == nil {
+		t.Error("Migrated to an unknown version")
+	}
+}
+
+// migration 11 splits shared tags between their users
+func TestMigrateTags(t *testing.T) {
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := openDB(sqlite, filepath.Join(t.TempDir(), "tags.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		testMigrateTags(t, db)
+	})
+
+	// in a scratch schema, to leave the test database alone
+	t.Run("postgres", func(t *testing.T) {
+		db, err := openDB(postgres, pgdsn+" search_path=migratetags")
+		if err == nil {
+			_, err = db.Exec(`CREATE SCHEMA IF NOT EXISTS migratetags`)
+		}
+		if err != nil {
+			t.Skip("backend unavailable:", err)
+		}
+		defer db.Close()
+		defer db.Exec(`DROP SCHEMA migratetags CASCADE`)
+		testMigrateTags(t, db)
+	})
+}
+
+func testMigrateTags(t *testing.T, db *Database) {
+	if err := db.Migrate(10); err != nil {
+		t.Fatal(err)
+	}
+	// documents without owner, or owned by uid 0, keep
+	// the shared tags
+	for _, q := range []string{
+		`INSERT INTO docs(id, name, type, content, uid, created, updated)
+			VALUES (1, 'a', 'text', '', 1, $1, $1), (2, 'b', 'text', '', 2, $1, $1),
+			(3, 'c', 'text', '', NULL, $1, $1), (4, 'd', 'text', '', 0, $1, $1)`,
+		`INSERT INTO tags(id, name) VALUES (101, 'linux'), (102, ':public')`,
+		`INSERT INTO tagsdocs(idtag, iddoc) VALUES (101, 1), (101, 2), (101, 3), (101, 4),
+			(102, 1), (102, 2), (102, 3), (102, 4)`,
+	} {
+		if _, err := db.Exec(q, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(q string) (n int) {
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if err := db.Migrate(11); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(`SELECT COUNT(*) FROM tags WHERE name = 'linux' AND uid IN (0, 1, 2)`); n != 3 ||
+	   count(`SELECT COUNT(*) FROM tags WHERE name = ':public' AND uid = 0`) != 1 ||
+	   count(`SELECT COUNT(*) FROM tags`) != 4 {
+		t.Error("Tags not split:", n)
+	}
+	if n := count(`SELECT COUNT(*) FROM tagsdocs, tags, docs
+		WHERE tags.id = tagsdocs.idtag AND docs.id = tagsdocs.iddoc
+		AND tags.uid = CASE WHEN tags.name LIKE ':%' THEN 0
+			ELSE coalesce(docs.uid, 0) END`); n != 8 {
+		t.Error("Documents lost their tags:", n)
+	}
+
+	if err := db.Migrate(10); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(`SELECT COUNT(*) FROM tags`); n != 2 || count(`SELECT COUNT(*) FROM tagsdocs`) != 8 {
+		t.Error("Tags not merged back:", n)
+	}
+}
+
+// concurrent transactions wait for each other
+func TestSQLiteConcurrent(t *testing.T) {
+	testdb, err := OpenSQLite(filepath.Join(t.TempDir(), "tags.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testdb.Close()
+
+	id := mustAdd(t, testdb, &Doc{ Id : -1, Name : "x", Type : "text", Content : "x",
+		Uid : 1, Tags : []string{"concurrent"} })
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*50)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				errs <- testdb.UpdateDoc(&Doc{ Id : id, Name : "x", Type : "text",
+					Content : strconv.Itoa(i*50+j), Uid : 1, Tags : []string{"concurrent", strconv.Itoa(i)} })
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal("Concurrent update failed:", err)
+		}
+	}
+}
+
+func TestTagNamespaces(t *testing.T) {
+	testdb, err := OpenSQLite(filepath.Join(t.TempDir(), "tags.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testdb.Close()
+
+	for _, uid := range []int32{ 1, 2 } {
+		mustAdd(t, testdb, &Doc{ Id : -1, Name : "ns", Type : "text", Content : "x",
+			Uid : uid, Tags : []string{"linux", ":public"} })
+	}
+
+	var owners []int32
+	rows, err := testdb.Query(`SELECT uid FROM tags ORDER BY uid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid int32
+		rows.Scan(&uid)
+		owners = append(owners, uid)
+	}
+	if len(owners) != 3 || owners[0] != 0 || owners[1] != 1 || owners[2] != 2 {
+		t.Error("Bad tag owners:", owners)
+	}
+
+	// searches still go by name
+	q, _ := ParseQuery("linux :public")
+	if ds := docsOf(t, testdb, 1, q, nil); len(ds) != 2 {
+		t.Error("Bad search:", ds)
+	}
+	if ts := tagsOf(t, testdb, 2); len(ts) != 2 || ts[0].Count != 1 {
+		t.Error("Bad tags:", ts)
+	}
+}
+
+func TestRank(t *testing.T) {
+	forEachStore(t, testRank)
+}
+
+// full-text results come by relevance
+func testRank(t *testing.T, testdb Store) {
+	var ids []int32
+	for _, c := range []string{
+		"a gopher",
+		"gopher, gopher, gophers everywhere: gopher",
+		"no match here",
+	} {
+		ids = append(ids, mustAdd(t, testdb, &Doc{ Id : -1, Name : "ranktest", Type : "text",
+			Content : c, Uid : 3, Tags : []string{"ranktest"} }))
+	}
+
+	q, _ := ParseQuery("ranktest text:gopher")
+	ds := docsOf(t, testdb, 3, q, nil)
+	if len(ds) != 2 || ds[0].Id != ids[1] || ds[1].Id != ids[0] {
+		t.Error("Bad ranking:", ds)
+	}
+
+	for _, id := range ids {
+		testdb.DelDoc(id)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	forEachStore(t, testTokens)
+}
+
+func testTokens(t *testing.T, testdb Store) {
+	_, hash, err := newToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testdb.AddToken(&Token{ Uid : 4, Scope : "all" }, hash); err == nil {
+		t.Error("Token with bad scope added")
+	}
+
+	id, err := testdb.AddToken(&Token{ Uid : 4, Name : "cli", Scope : "read" }, hash)
+	if err != nil {
+		t.Fatal("Cannot add token:", err)
+	}
+
+	if tok, err := testdb.GetToken(hash); err != nil || tok.Id != id ||
+	   tok.Uid != 4 || tok.Scope != "read" || tok.Created.IsZero() {
+		t.Error("Bad token:", tok, err)
+	}
+	if ts, err := testdb.GetTokens(4); err != nil || len(ts) != 1 || ts[0].Name != "cli" {
+		t.Error("Bad tokens:", ts, err)
+	}
+
+	if testdb.DelToken(id, 5) == nil {
+		t.Error("Foreign token revoked")
+	}
+	if err := testdb.DelToken(id, 4); err != nil {
+		t.Error("Cannot revoke token:", err)
+	}
+	if _, err := testdb.GetToken(hash); err == nil {
+		t.Error("Revoked token still valid")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	forEachStore(t, testUsers)
+}
+
+func testUsers(t *testing.T, testdb Store) {
+	name := "user"+strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	id, err := testdb.AddUser(name, "hash")
+	if err != nil {
+		t.Fatal("Cannot add user:", err)
+	}
+	if _, err := testdb.AddUser(name, "hash"); err == nil {
+		t.Error("Duplicate user added")
+	}
+
+	if u, err := testdb.GetUser(name); err != nil || u.Id != id || u.Hash != "hash" {
+		t.Error("Bad user:", u, err)
+	}
+	if _, err := testdb.GetUser(name+"nope"); err == nil {
+		t.Error("Unknown user found")
+	}
+
+	if err := testdb.AddLogin(id, name); err != nil {
+		t.Fatal("Cannot add login:", err)
+	}
+	if uid, err := testdb.GetLogin(name); err != nil || uid != id {
+		t.Error("Bad login:", uid, err)
+	}
+	if err := testdb.DelLogin(name); err != nil || testdb.DelLogin(name) != ErrNotFound {
+		t.Error("Cannot delete login:", err)
+	}
+	if _, err := testdb.GetLogin(name); err != ErrNotFound {
+		t.Error("Deleted login found:", err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, testdb Store) {
+		testSessions(t, testdb.(Sessions))
+	})
+}
+
+func testSessions(t *testing.T, ss Sessions) {
+	sid, err := newSid()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Round(time.Second)
+	s := &Session{ sid, 6, "token", "agent", "addr", now, now }
+	if err := ss.AddSession(s); err != nil {
+		t.Fatal("Cannot add session:", err)
+	}
+
+	s.Token, s.Seen = "token2", now.Add(time.Minute)
+	if err := ss.UpdateSession(s); err != nil {
+		t.Error("Cannot update session:", err)
+	}
+	if x, err := ss.GetSession(sid); err != nil || x.Uid != 6 ||
+	   x.Token != "token2" || !x.Seen.Equal(s.Seen) || x.Agent != "agent" {
+		t.Error("Bad session:", x, err)
+	}
+	if xs, err := ss.GetSessions(6); err != nil || len(xs) != 1 || xs[0].Id != sid {
+		t.Error("Bad sessions:", xs, err)
+	}
+
+	if ss.DelSession(sid, 7) == nil {
+		t.Error("Foreign session revoked")
+	}
+	if err := ss.DelSession(sid, 6); err != nil {
+		t.Error("Cannot revoke session:", err)
+	}
+	if _, err := ss.GetSession(sid); err == nil {
+		t.Error("Revoked session still valid")
+	}
+	if ss.UpdateSession(s) == nil {
+		t.Error("Revoked session updated")
+	}
+
+	// expiry, by last use
+	s.Id, s.Seen = sid+"old", time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := ss.AddSession(s); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ss.ExpireSessions(s.Seen); err != nil || n != 0 {
+		t.Error("Session expired too soon:", n, err)
+	}
+	if n, err := ss.ExpireSessions(s.Seen.Add(time.Second)); err != nil || n < 1 {
+		t.Error("Session not expired:", n, err)
+	}
+	if _, err := ss.GetSession(s.Id); err == nil {
+		t.Error("Expired session still valid")
+	}
+}
+
+func TestPrefs(t *testing.T) {
+	forEachStore(t, testPrefs)
+}
+
+func testPrefs(t *testing.T, testdb Store) {
+	uid := int32(time.Now().UnixNano() % 1000000)
+
+	if p, err := testdb.GetPrefs(uid); err != nil || p.PageSize != 0 || len(p.Tags) != 0 {
+		t.Error("Bad default preferences:", p, err)
+	}
+
+	for _, p := range []Prefs{
+		{ []string{"a", "b"}, "c -d", 20, true, "pre" },
+		{ nil, "", 0, false, "plain" },
+	} {
+		if err := testdb.SetPrefs(uid, &p); err != nil {
+			t.Fatal("Cannot set preferences:", err)
+		}
+		x, err := testdb.GetPrefs(uid)
+		if err != nil || strings.Join(x.Tags, ",") != strings.Join(p.Tags, ",") ||
+		   x.Search != p.Search || x.PageSize != p.PageSize ||
+		   x.Public != p.Public || x.Format != p.Format {
+			t.Error("Bad preferences:", x, err)
+		}
+	}
+}
+
+func TestPages(t *testing.T) {
+	forEachStore(t, testPages)
+}
+
+func testPages(t *testing.T, testdb Store) {
+	var ids []int32
+	for i, n := range []string{ "b", "A", "c", "b", "e", "d", "a" } {
+		ids = append(ids, mustAdd(t, testdb, &Doc{ Id : -1, Name : n, Type : "text",
+			Content : strings.Repeat("page ", i%3+1), Uid : 5, Tags : []string{"pagetest"} }))
+	}
+	defer func() {
+		for _, id := range ids {
+			testdb.DelDoc(id)
+		}
+	}()
+
+	// creation dates disagree with ids, two being equal
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, id := range ids {
+		setCreated(t, testdb, id, now.Add(-time.Duration(i/2)*time.Hour))
+	}
+
+	for _, query := range []string{ "pagetest", "pagetest text:page" } {
+		q, _ := ParseQuery(query)
+		for _, s := range []string{ "", "relevance", "name", "-name", "created", "-created",
+				"updated", "-updated" } {
+			all := docsOf(t, testdb, 5, q, &Page{ Sort : s })
+			if len(all) != len(ids) {
+				t.Fatal("Bad documents:", query, s, all)
+			}
+
+			// read by pages of 3
+			p := &Page{ Sort : s, Limit : 3 }
+			var ds []Doc
+			for n := 0; n < 5; n++ {
+				ds = append(ds, docsOf(t, testdb, 5, q, p)...)
+				if p.Cursor = p.Next; p.Next == "" {
+					break
+				}
+			}
+			for i := range all {
+				if i >= len(ds) || ds[i].Id != all[i].Id {
+					t.Error("Bad pages:", query, s, ds, all)
+					break
+				}
+			}
+			if len(ds) != len(all) {
+				t.Error("Bad pages:", query, s, ds, all)
+			}
+
+			for i := 1; i < len(all); i++ {
+				a, b := strings.ToLower(all[i-1].Name), strings.ToLower(all[i].Name)
+				if s == "name" && a > b || s == "-name" && a < b ||
+				   s == "created" && all[i-1].Created.After(all[i].Created) ||
+				   s == "-created" && all[i-1].Created.Before(all[i].Created) ||
+				   s == "updated" && all[i-1].Updated.After(all[i].Updated) ||
+				   s == "-updated" && all[i-1].Updated.Before(all[i].Updated) {
+					t.Error("Bad order:", s, all)
+				}
+			}
+		}
+	}
+}
+
+// backdate document id
+func setCreated(t *testing.T, testdb Store, id int32, created time.Time) {
+	switch st := testdb.(type) {
+	case *Database:
+		if _, err := st.Exec(`UPDATE docs SET created = $1 WHERE id = $2`, created, id); err != nil {
+			t.Fatal(err)
+		}
+	case *MemStore:
+		st.docs[id].Created = created
+	}
+}
+
+func TestDates(t *testing.T) {
+	forEachStore(t, testDates)
+}
+
+func testDates(t *testing.T, testdb Store) {
+	start := time.Now().Add(-time.Second)
+
+	id := mustAdd(t, testdb, &Doc{ Id : -1, Name : "dates", Type : "text",
+		Content : "x", Uid : 6, Tags : []string{"datetest"} })
+	defer testdb.DelDoc(id)
+
+	d := docOf(testdb, id)
+	if d.Created.Before(start) || !d.Created.Equal(d.Updated) {
+		t.Fatal("Bad dates:", d.Created, d.Updated)
+	}
+
+	time.Sleep(10*time.Millisecond)
+	d.Content = "y"
+	testdb.UpdateDoc(&d)
+	if d2 := docOf(testdb, id); !d2.Created.Equal(d.Created) || !d2.Updated.After(d.Updated) {
+		t.Error("Bad dates after update:", d2.Created, d2.Updated)
+	}
+
+	day := func(t time.Time) string { return t.UTC().Format("2006-01-02") }
+	yesterday, tomorrow := day(start.Add(-24*time.Hour)), day(start.Add(24*time.Hour))
+	for q, n := range map[string]int{
+		"datetest after:"+yesterday								:	1,
+		"datetest after:"+yesterday+" before:"+tomorrow			:	1,
+		"datetest after:"+tomorrow								:	0,
+		"datetest before:"+yesterday							:	0,
+		"datetest updated-after:"+start.UTC().Format(time.RFC3339)	:	1,
+		"datetest updated-before:"+start.UTC().Format(time.RFC3339)	:	0,
+	} {
+		e, err := ParseQuery(q)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		if ds := docsOf(t, testdb, 6, e, nil); len(ds) != n {
+			t.Error("Bad date search:", q, ds)
+		}
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	forEachStore(t, testRevisions)
+}
+
+func testRevisions(t *testing.T, testdb Store) {
+	id := mustAdd(t, testdb, &Doc{ Id : -1, Name : "v1", Type : "text",
+		Content : "one", Uid : 7, Tags : []string{"revtest", "a"} })
+	defer testdb.DelDoc(id)
+
+	d := docOf(testdb, id)
+	testdb.UpdateDoc(&d)
+	if rs, err := testdb.GetRevisions(id); err != nil || len(rs) != 0 {
+		t.Error("Revision saved without changes:", rs, err)
+	}
+
+	for _, v := range []Doc{
+		{ Id : id, Name : "v2", Type : "text", Content : "two", Uid : 7, Tags : []string{"revtest"} },
+		{ Id : id, Name : "v3", Type : "url", Content : "/three", Uid : 7 },
+	} {
+		testdb.UpdateDoc(&v)
+	}
+
+	rs, err := testdb.GetRevisions(id)
+	if err != nil || len(rs) != 2 || rs[0].Doc.Name != "v2" || rs[1].Doc.Name != "v1" ||
+	   rs[1].Doc.Content != "one" || len(rs[1].Doc.Tags) != 2 || len(rs[0].Doc.Tags) != 1 ||
+	   rs[0].Doc.Id != id || rs[0].Saved.Before(rs[1].Saved) {
+		t.Fatal("Bad revisions:", rs, err)
+	}
+
+	r, err := testdb.GetRevision(rs[1].Id)
+	if err != nil || r.Doc.Name != "v1" || r.Doc.Id != id {
+		t.Error("Bad revision:", r, err)
+	}
+	if _, err := testdb.GetRevision(rs[0].Id+1000); err == nil {
+		t.Error("Unknown revision found")
+	}
+}
+
+func TestTrash(t *testing.T) {
+	forEachStore(t, testTrash)
+}
+
+func testTrash(t *testing.T, testdb Store) {
+	uid := int32(time.Now().UnixNano() % 1000000 + 1000)
+
+	id := mustAdd(t, testdb, &Doc{ Id : -1, Name : "trashed", Type : "text",
+		Content : "x", Uid : uid, Tags : []string{"trashtest"} })
+	testdb.DelDoc(id)
+
+	if docOf(testdb, id).Id != -1 || testdb.CheckOwner(id, uid) != ErrNotFound ||
+	   len(docsOf(t, testdb, uid, nil, nil)) != 0 || len(tagsOf(t, testdb, uid)) != 0 {
+		t.Error("Trashed document still visible")
+	}
+	if d, err := testdb.GetDoc(id); err != ErrNotFound || d.Id != 0 {
+		t.Error("Bad missing document:", d.Id, err)
+	}
+	d := docOf(testdb, id)
+	d.Id, d.Name, d.Type = id, "updated", "text"
+	if testdb.UpdateDoc(&d) != ErrNotFound {
+		t.Error("Trashed document updated")
+	}
+
+	ts, err := testdb.GetTrash(uid)
+	if err != nil || len(ts) != 1 || ts[0].Id != id || ts[0].Name != "trashed" ||
+	   len(ts[0].Tags) != 1 || ts[0].Deleted.IsZero() {
+		t.Fatal("Bad trash:", ts, err)
+	}
+
+	if testdb.RestoreDoc(id, uid+1) == nil || testdb.PurgeDoc(id, uid+1) == nil {
+		t.Error("Foreign document restored or purged")
+	}
+	if err := testdb.RestoreDoc(id, uid); err != nil || docOf(testdb, id).Name != "trashed" {
+		t.Error("Cannot restore:", err)
+	}
+	if testdb.RestoreDoc(id, uid) == nil || testdb.PurgeDoc(id, uid) == nil {
+		t.Error("Live document restored or purged")
+	}
+
+	testdb.DelDoc(id)
+	if err := testdb.PurgeDoc(id, uid); err != nil {
+		t.Error("Cannot purge:", err)
+	}
+	if ts, _ := testdb.GetTrash(uid); len(ts) != 0 || testdb.RestoreDoc(id, uid) == nil {
+		t.Error("Purged document still there:", ts)
+	}
+
+	// expiry
+	id = mustAdd(t, testdb, &Doc{ Id : -1, Name : "expired", Type : "text",
+		Content : "x", Uid : uid, Tags : []string{"trashtest"} })
+	testdb.DelDoc(id)
+	if n, err := testdb.Expire(time.Now().Add(-time.Hour)); err != nil || len(trashOf(testdb, uid)) != 1 {
+		t.Error("Document expired too soon:", n, err)
+	}
+	if n, err := testdb.Expire(time.Now().Add(time.Second)); err != nil || n < 1 ||
+	   len(trashOf(testdb, uid)) != 0 {
+		t.Error("Document not expired:", n, err)
+	}
+}
+
+func trashOf(testdb Store, uid int32) []Trashed {
+	ts, _ := testdb.GetTrash(uid)
+	return ts
+}
+
+func TestAtomic(t *testing.T) {
+	forEachStore(t, testAtomic)
+}
+
+// failed mutations change nothing; documents without tags
+// remain reachable
+func testAtomic(t *testing.T, testdb Store) {
+	uid := int32(time.Now().UnixNano() % 1000000 + 2000000)
+
+	if id, err := testdb.AddDoc(&Doc{ Id : -1, Name : "bad", Type : "nope",
+		Content : "x", Uid : uid, Tags : []string{"atomictest-new"} }); !errors.Is(err, ErrInvalidType) || id != -1 {
+		t.Error("Invalid document added:", id, err)
+	}
+	if ts := tagsOf(t, testdb, uid); len(ts) != 0 || len(docsOf(t, testdb, uid, nil, nil)) != 0 {
+		t.Error("Failed add left traces:", ts)
+	}
+
+	id := mustAdd(t, testdb, &Doc{ Id : -1, Name : "good", Type : "text",
+		Content : "x", Uid : uid, Tags : []string{"atomictest"} })
+	defer testdb.DelDoc(id)
+
+	err := testdb.UpdateDoc(&Doc{ Id : id, Name : "bad", Type : "nope",
+		Content : "y", Uid : uid, Tags : []string{"atomictest-other"} })
+	d := docOf(testdb, id)
+	if !errors.Is(err, ErrInvalidType) || d.Name != "good" || d.Content != "x" || len(d.Tags) != 1 || d.Tags[0] != "atomictest" {
+		t.Error("Failed update left traces:", d, err)
+	}
+	if rs, _ := testdb.GetRevisions(id); len(rs) != 0 {
+		t.Error("Failed update saved a revision:", rs)
+	}
+
+	if testdb.UpdateDoc(&Doc{ Id : id+1000, Name : "x", Type : "text", Uid : uid }) != ErrNotFound ||
+	   testdb.DelDoc(id+1000) != ErrNotFound {
+		t.Error("Unknown document updated or deleted")
+	}
+
+	// tags, if any, are required by handlers, not by stores
+	if db, ok := testdb.(*Database); ok {
+		if _, err := db.Exec(`DELETE FROM tagsdocs WHERE iddoc = $1`, id); err != nil {
+			t.Fatal(err)
+		}
+		if d := docOf(testdb, id); d.Id != id || len(d.Tags) != 0 {
+			t.Error("Untagged document not found:", d)
+		}
+	}
+}
+
+func TestTagAdmin(t *testing.T) {
+	forEachStore(t, testTagAdmin)
+}
+
+// rename, merge and delete tags
+func testTagAdmin(t *testing.T, testdb Store) {
+	uid := int32(time.Now().UnixNano() % 1000000 + 3000000)
+	names := func(id int32) string {
+		d := docOf(testdb, id)
+		sort.Strings(d.Tags)
+		return strings.Join(d.Tags, " ")
+	}
+
+	a := mustAdd(t, testdb, &Doc{ Id : -1, Name : "a", Type : "text", Content : "x",
+		Uid : uid, Tags : []string{"go", "golang", ":public"} })
+	b := mustAdd(t, testdb, &Doc{ Id : -1, Name : "b", Type : "text", Content : "x",
+		Uid : uid, Tags : []string{"golang", "c"} })
+	other := mustAdd(t, testdb, &Doc{ Id : -1, Name : "other", Type : "text", Content : "x",
+		Uid : uid+1, Tags : []string{"go", ":public"} })
+	defer testdb.DelDoc(a)
+	defer testdb.DelDoc(b)
+	defer testdb.DelDoc(other)
+
+	for _, test := range []struct {
+		from	[]string
+		to		string
+		err		error
+	}{
+		{ []string{"go"}, "", ErrNoTags },
+		{ nil, "go", ErrNoTags },
+		{ []string{"go"}, "two words", ErrBadTag },
+		{ []string{":public"}, "pub", ErrSystemTag },
+		{ []string{"go"}, ":public", ErrSystemTag },
+		{ []string{"go", "nope"}, "lang", ErrNotFound },
+	} {
+		if err := testdb.MergeTags(uid, test.from, test.to); !errors.Is(err, test.err) {
+			t.Error("Bad merge accepted:", test, err)
+		}
+	}
+	if names(a) != ":public go golang" || names(b) != "c golang" {
+		t.Fatal("Failed merge left traces:", names(a), names(b))
+	}
+
+	// rename
+	if err := testdb.MergeTags(uid, []string{"c"}, "clang"); err != nil || names(b) != "clang golang" {
+		t.Error("Tag not renamed:", names(b), err)
+	}
+	// merge: a doc tagged twice keeps one tag
+	if err := testdb.MergeTags(uid, []string{"go", "golang"}, "go"); err != nil ||
+	   names(a) != ":public go" || names(b) != "clang go" {
+		t.Error("Tags not merged:", names(a), names(b), err)
+	}
+	// tags are per user
+	if names(other) != ":public go" {
+		t.Error("Foreign tags changed:", names(other))
+	}
+	if ts := tagsOf(t, testdb, uid); len(ts) != 3 {
+		t.Error("Bad tags:", ts)
+	}
+
+	// new documents use the new tags (cf. the tag cache)
+	c := mustAdd(t, testdb, &Doc{ Id : -1, Name : "c", Type : "text", Content : "x",
+		Uid : uid, Tags : []string{"golang"} })
+	defer testdb.DelDoc(c)
+	if names(c) != "golang" {
+		t.Error("Stale tags:", names(c))
+	}
+
+	// delete, trashed documents included
+	testdb.DelDoc(b)
+	if err := testdb.DelTag(uid, "go"); err != nil {
+		t.Error("Cannot delete tag:", err)
+	}
+	testdb.RestoreDoc(b, uid)
+	if names(a) != ":public" || names(b) != "clang" {
+		t.Error("Tag not deleted:", names(a), names(b))
+	}
+	if err := testdb.DelTag(uid, "go"); err != ErrNotFound {
+		t.Error("Deleted tag deleted again:", err)
+	}
+	// so are tags no document carries anymore
+	d := docOf(testdb, c)
+	d.Tags = []string{"clang"}
+	if err := testdb.UpdateDoc(&d); err != nil {
+		t.Fatal(err)
+	}
+	if err := testdb.DelTag(uid, "golang"); err != ErrNotFound {
+		t.Error("Unused tag deleted:", err)
+	}
+
+	// system tags are only removed from one's documents
+	if err := testdb.DelTag(uid, ":public"); err != nil || names(a) != "" || names(other) != ":public go" {
+		t.Error("Bad system tag deletion:", names(a), names(other), err)
+	}
+}
+
+func TestTagTree(t *testing.T) {
+	forEachStore(t, testTagTree)
+}
+
+// hierarchical tags: searches, subtree moves
+func testTagTree(t *testing.T, testdb Store) {
+	uid := int32(time.Now().UnixNano() % 1000000 + 4000000)
+	names := func(id int32) string {
+		d := docOf(testdb, id)
+		sort.Strings(d.Tags)
+		return strings.Join(d.Tags, " ")
+	}
+	search := func(q string) int {
+		e, err := ParseQuery(q)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		return len(docsOf(t, testdb, uid, e, nil))
+	}
+
+	a := mustAdd(t, testdb, &Doc{ Id : -1, Name : "a", Type : "text", Content : "x",
+		Uid : uid, Tags : []string{"science/physics/quantum", "sciencefiction"} })
+	b := mustAdd(t, testdb, &Doc{ Id : -1, Name : "b", Type : "text", Content : "x",
+		Uid : uid, Tags : []string{"science", "science/maths"} })
+	defer testdb.DelDoc(a)
+	defer testdb.DelDoc(b)
+
+	for q, n := range map[string]int{
+		"science"					:	2,
+		"science/physics"			:	1,
+		"science -science/maths"	:	1,
+		"scien"						:	0,
+		"sciencefiction"			:	1,
+	} {
+		if m := search(q); m != n {
+			t.Error("Bad search:", q, m, n)
+		}
+	}
+
+	if err := testdb.MergeTags(uid, []string{"science"}, "science/physics"); err != ErrTagLoop {
+		t.Error("Tag moved under itself:", err)
+	}
+
+	// moving a subtree, without an own tag
+	if err := testdb.MergeTags(uid, []string{"science/physics"}, "physics"); err != nil ||
+	   names(a) != "physics/quantum sciencefiction" {
+		t.Error("Subtree not moved:", names(a), err)
+	}
+	// tags renamed to renamed tags
+	if err := testdb.MergeTags(uid, []string{"physics", "science/maths"}, "science"); err != nil ||
+	   names(a) != "science/quantum sciencefiction" || names(b) != "science" {
+		t.Error("Bad merge:", names(a), names(b), err)
+	}
+	if search("physics") != 0 || search("science/quantum") != 1 {
+		t.Error("Bad search after move")
+	}
+
+	// tags under several of from: the first wins
+	for _, from := range [][]string{ {"science", "science/quantum"}, {"sciencefiction", "sciencefiction"} } {
+		if err := testdb.MergeTags(uid, from, "sf"); err != nil {
+			t.Error("Cannot merge:", from, err)
+		}
+	}
+	if names(a) != "sf sf/quantum" || names(b) != "sf" {
+		t.Error("Bad merge:", names(a), names(b))
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+// Pure Go, in-memory Store: nothing survives a restart.
+// Used by tests and demos (-db memory).
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// document types, as in PostgreSQL's dtype enum
+var dtypes = []string{ "text", "url", "pdf", "ps" }
+
+func validType(t string) bool {
+	for _, x := range dtypes {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+type MemStore struct {
+	sync.RWMutex
+	*MemSessions
+	docs	map[int32]*Doc
+	lastid	int32
+
+	revs	map[int32][]Revision	// by document, oldest first
+	trash	map[int32]*Trashed
+	lastrev	int32
+
+	tokens	map[string]*Token	// by hash
+	lasttok	int32
+
+	users	map[string]*User	// by name
+	logins	map[string]int32	// uids, by hash
+	prefs	map[int32]Prefs
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		MemSessions	:	NewMemSessions(),
+		docs	:	make(map[int32]*Doc),
+		revs	:	make(map[int32][]Revision),
+		trash	:	make(map[int32]*Trashed),
+		tokens	:	make(map[string]*Token),
+		users	:	make(map[string]*User),
+		logins	:	make(map[string]int32),
+		prefs	:	make(map[int32]Prefs),
+	}
+}
+
+// copy d so that callers can't alter the store.
+func copyDoc(d *Doc) Doc {
+	c := *d
+	c.Tags = append([]string(nil), d.Tags...)
+	return c
+}
+
+// remove separator from tags, as Database.AddTag does
+func cleanTags(tags []string) []string {
+	res := make([]string, len(tags))
+	for i, tag := range tags {
+		res[i] = strings.Replace(tag, TagSep, "", -1)
+	}
+	return res
+}
+
+func hasTag(d *Doc, tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemStore) CheckOwner(id, uid int32) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	d, ok := m.docs[id]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case d.Uid != uid:
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (m *MemStore) GetDoc(id int32) (Doc, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	d, ok := m.docs[id]
+	if !ok {
+		return Doc{}, ErrNotFound
+	}
+	return copyDoc(d), nil
+}
+
+// Same rules as Database.GetDocs: without query, all uid's
+// documents; otherwise, documents matching q owned by uid
+// or tagged :public, by relevance for full-text searches.
+func (m *MemStore) GetDocs(uid int32, q Expr, p *Page) (ds []Doc, err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, d := range m.docs {
+		switch {
+		case q == nil && d.Uid != uid:
+		case q != nil && d.Uid != uid && !hasTag(d, ":public"):
+		case q != nil && !q.Match(d):
+		default:
+			ds = append(ds, copyDoc(d))
+		}
+	}
+
+	ws := Terms(q)
+	by, desc := p.order(q)
+	key := func(d *Doc) cursor {
+		c := cursor{ Id : d.Id }
+		switch by {
+		case "name":
+			c.Name = strings.ToLower(d.Name)
+		case "relevance":
+			c.Rank = float64(rank(d, ws))
+		case "created":
+			c.Time = d.Created.UnixNano()
+		case "updated":
+			c.Time = d.Updated.UnixNano()
+		}
+		return c
+	}
+
+	// is a before b?
+	before := func(a, b cursor) bool {
+		if a == b {
+			return false
+		}
+		less := a.Id < b.Id
+		switch {
+		case a.Name != b.Name:
+			less = a.Name < b.Name
+		case a.Rank != b.Rank:
+			less = a.Rank < b.Rank
+		case a.Time != b.Time:
+			less = a.Time < b.Time
+		}
+		return less != desc
+	}
+
+	// keys are computed once: ranking tokenizes documents
+	keys := make(map[int32]cursor, len(ds))
+	for i := range ds {
+		keys[ds[i].Id] = key(&ds[i])
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		return before(keys[ds[i].Id], keys[ds[j].Id])
+	})
+
+	if c := p.cursor(); c != nil {
+		i := sort.Search(len(ds), func(i int) bool { return before(*c, keys[ds[i].Id]) })
+		ds = ds[i:]
+	}
+
+	if p != nil {
+		var c cursor
+		n := len(ds)
+		if p.Limit > 0 && n > p.Limit {
+			ds = ds[:p.Limit]
+		}
+		if len(ds) > 0 {
+			c = keys[ds[len(ds)-1].Id]
+		}
+		p.next(n, &c)
+	}
+
+	return
+}
+
+// relevance of d for ws: number of occurrences
+func rank(d *Doc, ws []string) (n int) {
+	if len(ws) == 0 {
+		return
+	}
+	for _, w := range words(d.Name+" "+d.Content) {
+		for _, x := range ws {
+			if w == x {
+				n++
+			}
+		}
+	}
+	return
+}
+
+func (m *MemStore) AddDoc(d *Doc) (int32, error) {
+	if !validType(d.Type) {
+		return -1, invalidType(d.Type)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.lastid++
+	c := copyDoc(d)
+	c.Id = m.lastid
+	c.Tags = cleanTags(d.Tags)
+	c.Created = time.Now().UTC()
+	c.Updated = c.Created
+	m.docs[c.Id] = &c
+
+	return c.Id, nil
+}
+
+func (m *MemStore) UpdateDoc(d *Doc) error {
+	if !validType(d.Type) {
+		return invalidType(d.Type)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	old, ok := m.docs[d.Id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	if changed(old, d) {
+		m.lastrev++
+		m.revs[d.Id] = append(m.revs[d.Id], Revision{ m.lastrev, copyDoc(old), time.Now().UTC() })
+	}
+
+	old.Name, old.Type, old.Content = d.Name, d.Type, d.Content
+	old.Updated = time.Now().UTC()
+	if len(d.Tags) > 0 {
+		old.Tags = cleanTags(d.Tags)
+	}
+
+	return nil
+}
+
+func (m *MemStore) DelDoc(id int32) error {
+	m.Lock()
+	defer m.Unlock()
+
+	d, ok := m.docs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.trash[id] = &Trashed{ *d, time.Now().UTC() }
+	delete(m.docs, id)
+
+	return nil
+}
+
+func (m *MemStore) GetTrash(uid int32) (ts []Trashed, err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, t := range m.trash {
+		if t.Uid == uid {
+			ts = append(ts, Trashed{ copyDoc(&t.Doc), t.Deleted })
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if !ts[i].Deleted.Equal(ts[j].Deleted) {
+			return ts[i].Deleted.After(ts[j].Deleted)
+		}
+		return ts[i].Id < ts[j].Id
+	})
+
+	return
+}
+
+func (m *MemStore) RestoreDoc(id, uid int32) error {
+	m.Lock()
+	defer m.Unlock()
+
+	t, ok := m.trash[id]
+	if !ok || t.Uid != uid {
+		return ErrNotFound
+	}
+	m.docs[id] = &t.Doc
+	delete(m.trash, id)
+	return nil
+}
+
+func (m *MemStore) PurgeDoc(id, uid int32) error {
+	m.Lock()
+	defer m.Unlock()
+
+	t, ok := m.trash[id]
+	if !ok || t.Uid != uid {
+		return ErrNotFound
+	}
+	delete(m.trash, id)
+	delete(m.revs, id)
+	return nil
+}
+
+func (m *MemStore) Expire(before time.Time) (n int64, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, t := range m.trash {
+		if t.Deleted.Before(before) {
+			delete(m.trash, id)
+			delete(m.revs, id)
+			n++
+		}
+	}
+	return
+}
+
+func (m *MemStore) GetRevisions(id int32) (rs []Revision, err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for i := len(m.revs[id])-1; i >= 0; i-- {
+		r := m.revs[id][i]
+		r.Doc = copyDoc(&r.Doc)
+		rs = append(rs, r)
+	}
+	return
+}
+
+func (m *MemStore) GetRevision(rid int32) (Revision, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, rs := range m.revs {
+		for _, r := range rs {
+			if r.Id == rid {
+				r.Doc = copyDoc(&r.Doc)
+				return r, nil
+			}
+		}
+	}
+	return Revision{}, ErrNotFound
+}
+
+func (m *MemStore) GetTags(uid int32) (ts []Tag, err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	n := make(map[string]int)
+	for _, d := range m.docs {
+		if d.Uid == uid {
+			for _, t := range d.Tags {
+				n[t]++
+			}
+		}
+	}
+
+	for name, count := range n {
+		ts = append(ts, Tag{ name, count })
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+
+	return
+}
+
+func (m *MemStore) MergeTags(uid int32, from []string, to string) error {
+	if err := checkMerge(from, to); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	ds := m.owned(uid)
+	found := make([]bool, len(from))
+	for _, d := range ds {
+		for _, t := range d.Tags {
+			markUnder(found, t, from)
+		}
+	}
+	for _, ok := range found {
+		if !ok {
+			return ErrNotFound
+		}
+	}
+
+	for _, d := range ds {
+		var tags []string
+		for _, t := range d.Tags {
+			if t = mergedTag(t, from, to); !hasTag(&Doc{ Tags : tags }, t) {
+				tags = append(tags, t)
+			}
+		}
+		d.Tags = tags
+	}
+
+	return nil
+}
+
+func (m *MemStore) DelTag(uid int32, name string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	found := false
+	for _, d := range m.owned(uid) {
+		var tags []string
+		for _, t := range d.Tags {
+			if t != name {
+				tags = append(tags, t)
+			}
+		}
+		found = found || len(tags) < len(d.Tags)
+		d.Tags = tags
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// uid's documents, trashed included
+func (m *MemStore) owned(uid int32) (ds []*Doc) {
+	for _, d := range m.docs {
+		if d.Uid == uid {
+			ds = append(ds, d)
+		}
+	}
+	for _, t := range m.trash {
+		if t.Uid == uid {
+			ds = append(ds, &t.Doc)
+		}
+	}
+	return
+}
+
+func (m *MemStore) AddToken(t *Token, hash string) (int32, error) {
+	if t.Scope != "read" && t.Scope != "write" {
+		return -1, errors.New("Invalid scope: "+t.Scope)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.tokens[hash]; ok {
+		return -1, errors.New("Duplicate token")
+	}
+
+	m.lasttok++
+	c := *t
+	c.Id, c.Created = m.lasttok, time.Now()
+	m.tokens[hash] = &c
+
+	return c.Id, nil
+}
+
+func (m *MemStore) GetToken(hash string) (Token, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if t, ok := m.tokens[hash]; ok {
+		return *t, nil
+	}
+	return Token{}, ErrNotFound
+}
+
+func (m *MemStore) GetTokens(uid int32) (ts []Token, err error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, t := range m.tokens {
+		if t.Uid == uid {
+			ts = append(ts, *t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Id < ts[j].Id })
+
+	return
+}
+
+func (m *MemStore) DelToken(id, uid int32) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for h, t := range m.tokens {
+		if t.Id == id && t.Uid == uid {
+			delete(m.tokens, h)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemStore) AddUser(name, hash string) (int32, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.users[name]; ok {
+		return -1, errors.New("Duplicate user")
+	}
+
+	u := &User{ int32(len(m.users)+1), name, hash }
+	m.users[name] = u
+
+	return u.Id, nil
+}
+
+func (m *MemStore) GetUser(name string) (User, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if u, ok := m.users[name]; ok {
+		return *u, nil
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *MemStore) AddLogin(uid int32, hash string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.logins[hash] = uid
+	return nil
+}
+
+func (m *MemStore) GetLogin(hash string) (int32, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if uid, ok := m.logins[hash]; ok {
+		return uid, nil
+	}
+	return 0, ErrNotFound
+}
+
+func (m *MemStore) DelLogin(hash string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.logins[hash]; !ok {
+		return ErrNotFound
+	}
+	delete(m.logins, hash)
+	return nil
+}
+
+func (m *MemStore) GetPrefs(uid int32) (Prefs, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	p := m.prefs[uid]
+	p.Tags = append([]string(nil), p.Tags...)
+	return p, nil
+}
+
+func (m *MemStore) SetPrefs(uid int32, p *Prefs) error {
+	m.Lock()
+	defer m.Unlock()
+
+	c := *p
+	c.Tags = cleanTags(p.Tags)
+	m.prefs[uid] = c
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+// Schema migrations for SQL backends. Each dialect lists its
+// migrations; migration n (from 1) moves the schema from
+// version n-1 to n, and back. The current version is stored
+// in schema_version; version 0 is an empty database (or one
+// created before migrations existed).
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+type migration struct {
+	up		string
+	down	string
+}
+
+// Version returns the current schema version.
+func (db *Database) Version() (int, error) {
+	err := db.create(`CREATE TABLE IF NOT EXISTS
+		schema_version(
+			version		INTEGER		NOT NULL
+		)
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	var v int
+	err = db.QueryRow("SELECT version FROM schema_version").Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return v, err
+}
+
+// Latest schema version known by this binary.
+func (db *Database) Latest() int {
+	return len(db.dialect.migrations)
+}
+
+// Migrate moves the schema to version target, one migration
+// (and transaction) at a time.
+func (db *Database) Migrate(target int) error {
+	if target < 0 || target > db.Latest() {
+		return errors.New("no such schema version: "+strconv.Itoa(target))
+	}
+
+	v, err := db.Version()
+	if err != nil {
+		return err
+	}
+
+	for ; v < target; v++ {
+		if err := db.step(db.dialect.migrations[v].up, v+1); err != nil {
+			return fmt.Errorf("migration %d up: %s", v+1, err)
+		}
+	}
+	for ; v > target; v-- {
+		if err := db.step(db.dialect.migrations[v-1].down, v-1); err != nil {
+			return fmt.Errorf("migration %d down: %s", v, err)
+		}
+	}
+
+	return nil
+}
+
+// run descr and set version to v, atomically
+func (db *Database) step(descr string, v int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(descr); err == nil {
+		if _, err = tx.Exec("DELETE FROM schema_version"); err == nil {
+			_, err = tx.Exec("INSERT INTO schema_version(version) VALUES ("+
+				strconv.Itoa(v)+")")
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Migrate to the latest version if -automigrate, otherwise
+// refuse to run on an outdated schema. Refuse to run on a
+// schema more recent than what we know of in any case.
+func (db *Database) upToDate() error {
+	v, err := db.Version()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v > db.Latest():
+		return fmt.Errorf("schema version %d is newer than %d (latest known)",
+			v, db.Latest())
+	case v < db.Latest() && *automigrate:
+		return db.Migrate(db.Latest())
+	case v < db.Latest():
+		return fmt.Errorf("schema version %d is outdated (latest: %d); "+
+			"run migrate", v, db.Latest())
+	}
+
+	return nil
+}
+
+// migrate [status | up | down | N]
+//	status	print current and latest versions (default)
+//	up		migrate to the latest version
+//	down	undo the last migration
+//	N		migrate to version N
+func migrate(args []string) error {
+	d, ok := dialects[*backend]
+	if !ok {
+		return errors.New("no migrations for backend "+*backend)
+	}
+
+	db, err := openDB(d, *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	v, err := db.Version()
+	if err != nil {
+		return err
+	}
+
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	target := v
+	switch cmd {
+	case "status":
+		fmt.Printf("schema version: %d (latest: %d)\n", v, db.Latest())
+		return nil
+	case "up":
+		target = db.Latest()
+	case "down":
+		target = v-1
+	default:
+		if target, err = strconv.Atoi(cmd); err != nil {
+			return errors.New("usage: migrate [status | up | down | N]")
+		}
+	}
+
+	if err := db.Migrate(target); err != nil {
+		return err
+	}
+	fmt.Printf("schema version: %d -> %d\n", v, target)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+// Sorted, paginated searches. Pagination is keyset based: the
+// cursor of a page holds the sort key of the previous page's
+// last document, so pages stay consistent while documents are
+// added or removed.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sort orders; a "-" prefix reverses them. Relevance is from
+// the most to the least relevant, and only applies to full-text
+// searches (defaulting to created otherwise).
+var sorts = []string{ "relevance", "name", "created", "updated" }
+
+// Page selects a slice of sorted search results.
+type Page struct {
+	Sort	string	// cf. sorts; "" for the default
+	Limit	int		// 0 for all
+	Cursor	string	// from a previous Next; "" for the first page
+	Next	string	// set by GetDocs; "" on the last page
+}
+
+// position in the results: last document of a page
+type cursor struct {
+	Id		int32
+	Name	string	`json:",omitempty"`
+	Rank	float64	`json:",omitempty"`
+	Time	int64	`json:",omitempty"`	// created or updated, in ns
+}
+
+func (c *cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCursor(s string) (*cursor, error) {
+	var c cursor
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return nil, errors.New("Bad cursor")
+	}
+	return &c, nil
+}
+
+// Check p's sort and cursor.
+func (p *Page) Check() error {
+	if p == nil {
+		return nil
+	}
+	if p.Limit < 0 {
+		return errors.New("Bad limit")
+	}
+	if p.Cursor != "" {
+		if _, err := parseCursor(p.Cursor); err != nil {
+			return err
+		}
+	}
+	if p.Sort == "" {
+		return nil
+	}
+	s := strings.TrimPrefix(p.Sort, "-")
+	for _, x := range sorts {
+		if s == x {
+			return nil
+		}
+	}
+	return errors.New("Unknown sort: "+p.Sort)
+}
+
+// read page parameters from r's sort, limit and cursor
+func readPage(r *http.Request) (*Page, error) {
+	p := &Page{ Sort : r.FormValue("sort"), Cursor : r.FormValue("cursor") }
+
+	if l := r.FormValue("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return p, errors.New("Bad limit")
+		}
+		p.Limit = n
+	}
+
+	return p, p.Check()
+}
+
+// order returns the sort key of p for q, and whether
+// it is descending.
+func (p *Page) order(q Expr) (key string, desc bool) {
+	var rev bool
+
+	if p != nil {
+		key, rev = strings.TrimPrefix(p.Sort, "-"), strings.HasPrefix(p.Sort, "-")
+	}
+
+	if key == "" || key == "relevance" {
+		key = "relevance"
+		if len(Terms(q)) == 0 {
+			key = "created"
+		}
+	}
+
+	return key, (key == "relevance") != rev
+}
+
+// cursor to resume after position c, if p's
+// page has been filled (n documents found).
+func (p *Page) next(n int, c *cursor) {
+	p.Next = ""
+	if p.Limit > 0 && n > p.Limit {
+		p.Next = c.String()
+	}
+}
+
+// key time of c
+func (c *cursor) time() time.Time {
+	return time.Unix(0, c.Time).UTC()
+}
+
+// current cursor of p, nil for the first page
+func (p *Page) cursor() *cursor {
+	if p == nil || p.Cursor == "" {
+		return nil
+	}
+	c, err := parseCursor(p.Cursor)
+	if err != nil {
+		LogError(err)
+	}
+	return c
+}
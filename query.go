@@ -0,0 +1,366 @@
+package main
+
+// Search query language:
+//	programming -reddit (physics OR maths) "quoted tag"
+//	text:gopher physics text:"go channels"
+// A tag also matches its descendants (science matches
+// science/physics, cf. TagPathSep).
+// Tags juxtaposed (or joined by AND) must all be present; OR,
+// NOT (or a leading -) and parentheses work as expected, NOT
+// binding tighter than AND, which binds tighter than OR.
+// Operators are upper-case, so that "or" remains a valid tag.
+// text:words is a full-text search on documents' name and
+// content: all the words must be present, case-insensitively.
+// after:date and before:date select documents created on or
+// after, or before, a date (2006-01-02, or RFC 3339 in UTC);
+// updated-after:date and updated-before:date work likewise
+// on the modification date.
+//
+// Queries are parsed to an Expr, that SQL backends compile to
+// a WHERE clause and others evaluate with Match.
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Expr interface {
+	// does document d match?
+	Match(d *Doc) bool
+	// parenthesized form, for debugging
+	String() string
+}
+
+type TagExpr string
+
+// full-text search
+type TextExpr string
+
+// documents created (or updated) before, or on or after, T
+type DateExpr struct {
+	Updated		bool
+	Before		bool
+	T			time.Time
+}
+
+type AndExpr struct {
+	X, Y	Expr
+}
+
+type OrExpr struct {
+	X, Y	Expr
+}
+
+type NotExpr struct {
+	X		Expr
+}
+
+func (e TagExpr) Match(d *Doc) bool {
+	for _, t := range d.Tags {
+		if tagUnder(t, string(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e TextExpr) Match(d *Doc) bool {
+	ws := make(map[string]bool)
+	for _, w := range words(d.Name+" "+d.Content) {
+		ws[w] = true
+	}
+	for _, w := range words(string(e)) {
+		if !ws[w] {
+			return false
+		}
+	}
+	return true
+}
+
+func (e DateExpr) Match(d *Doc) bool {
+	t := d.Created
+	if e.Updated {
+		t = d.Updated
+	}
+	return t.Before(e.T) == e.Before
+}
+
+func (e *AndExpr) Match(d *Doc) bool {
+	return e.X.Match(d) && e.Y.Match(d)
+}
+
+func (e *OrExpr) Match(d *Doc) bool {
+	return e.X.Match(d) || e.Y.Match(d)
+}
+
+func (e *NotExpr) Match(d *Doc) bool {
+	return !e.X.Match(d)
+}
+
+func (e TagExpr) String() string	{ return string(e) }
+func (e TextExpr) String() string	{ return `text:"`+string(e)+`"` }
+func (e DateExpr) String() string	{ return e.op()+e.T.Format(time.RFC3339) }
+func (e *AndExpr) String() string	{ return "("+e.X.String()+" AND "+e.Y.String()+")" }
+func (e *OrExpr) String() string	{ return "("+e.X.String()+" OR "+e.Y.String()+")" }
+func (e *NotExpr) String() string	{ return "NOT "+e.X.String() }
+
+// date search operators
+var dateops = map[string]DateExpr{
+	"after:"			:	{},
+	"before:"			:	{ Before : true },
+	"updated-after:"	:	{ Updated : true },
+	"updated-before:"	:	{ Updated : true, Before : true },
+}
+
+func (e DateExpr) op() string {
+	for op, x := range dateops {
+		if x.Updated == e.Updated && x.Before == e.Before {
+			return op
+		}
+	}
+	return ""
+}
+
+// parseDate parses a date search (eg. after:2024-01-01)
+func parseDate(s string) (Expr, error) {
+	for op, e := range dateops {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		var err error
+		d := s[len(op):]
+		if e.T, err = time.Parse("2006-01-02", d); err != nil {
+			if e.T, err = time.Parse(time.RFC3339, d); err != nil {
+				return nil, errors.New("bad date: "+d)
+			}
+		}
+		e.T = e.T.UTC()
+		return e, nil
+	}
+	return nil, errors.New("bad date search: "+s)
+}
+
+// words splits s in lower-cased words, for full-text search.
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Terms returns the words searched for in full-text, excluding
+// negated ones; used for ranking and highlighting.
+func Terms(e Expr) (ws []string) {
+	switch e := e.(type) {
+	case TextExpr:
+		ws = words(string(e))
+	case *AndExpr:
+		ws = append(Terms(e.X), Terms(e.Y)...)
+	case *OrExpr:
+		ws = append(Terms(e.X), Terms(e.Y)...)
+	}
+	return
+}
+
+const (
+	tokTag = iota
+	tokText
+	tokDate
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind	int
+	val		string
+}
+
+func isSep(r rune) bool {
+	return unicode.IsSpace(r) || r == ',' || r == []rune(TagSep)[0]
+}
+
+func lex(s string) (toks []token, err error) {
+	rs := []rune(s)
+
+	for i := 0; i < len(rs); {
+		switch r := rs[i]; {
+		case isSep(r):
+			i++
+		case r == '(':
+			toks, i = append(toks, token{ tokLParen, "(" }), i+1
+		case r == ')':
+			toks, i = append(toks, token{ tokRParen, ")" }), i+1
+		case r == '-':
+			toks, i = append(toks, token{ tokNot, "-" }), i+1
+		case r == '"':
+			var w string
+			if w, i, err = quoted(rs, i); err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{ tokTag, w })
+		default:
+			j := i
+			for j < len(rs) && !isSep(rs[j]) && !strings.ContainsRune(`()"`, rs[j]) {
+				j++
+			}
+			w := string(rs[i:j])
+			switch {
+			case w == "text:" && j < len(rs) && rs[j] == '"':
+				if w, j, err = quoted(rs, j); err != nil {
+					return nil, err
+				}
+				toks = append(toks, token{ tokText, w })
+			case strings.HasPrefix(w, "text:"):
+				toks = append(toks, token{ tokText, w[len("text:"):] })
+			case isDate(w):
+				toks = append(toks, token{ tokDate, w })
+			case w == "AND":
+				toks = append(toks, token{ tokAnd, w })
+			case w == "OR":
+				toks = append(toks, token{ tokOr, w })
+			case w == "NOT":
+				toks = append(toks, token{ tokNot, w })
+			default:
+				toks = append(toks, token{ tokTag, w })
+			}
+			i = j
+		}
+	}
+
+	return
+}
+
+func isDate(w string) bool {
+	for op := range dateops {
+		if strings.HasPrefix(w, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// quoted reads the "string" starting at rs[i]; returns
+// the string and the position following it.
+func quoted(rs []rune, i int) (string, int, error) {
+	var b []rune
+	for i++; i < len(rs) && rs[i] != '"'; i++ {
+		if rs[i] == '\\' && i+1 < len(rs) {
+			i++
+		}
+		b = append(b, rs[i])
+	}
+	if i == len(rs) {
+		return "", i, errors.New("unterminated quote")
+	}
+	return string(b), i+1, nil
+}
+
+type parser struct {
+	toks	[]token
+	pos		int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos], true
+	}
+	return token{}, false
+}
+
+// or := and (OR and)*
+func (p *parser) or() (Expr, error) {
+	x, err := p.and()
+	for err == nil {
+		t, ok := p.peek()
+		if !ok || t.kind != tokOr {
+			break
+		}
+		p.pos++
+		var y Expr
+		if y, err = p.and(); err == nil {
+			x = &OrExpr{ x, y }
+		}
+	}
+	return x, err
+}
+
+// and := unary ([AND] unary)*
+func (p *parser) and() (Expr, error) {
+	x, err := p.unary()
+	for err == nil {
+		t, ok := p.peek()
+		if !ok || t.kind == tokOr || t.kind == tokRParen {
+			break
+		}
+		if t.kind == tokAnd {
+			p.pos++
+		}
+		var y Expr
+		if y, err = p.unary(); err == nil {
+			x = &AndExpr{ x, y }
+		}
+	}
+	return x, err
+}
+
+// unary := (NOT | -) unary | ( or ) | tag | text:words | date
+func (p *parser) unary() (Expr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errors.New("unexpected end of query")
+	}
+	p.pos++
+
+	switch t.kind {
+	case tokNot:
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpr{ x }, nil
+	case tokLParen:
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != tokRParen {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return x, nil
+	case tokTag:
+		return TagExpr(t.val), nil
+	case tokText:
+		if len(words(t.val)) == 0 {
+			return nil, errors.New("empty text search")
+		}
+		return TextExpr(t.val), nil
+	case tokDate:
+		return parseDate(t.val)
+	}
+
+	return nil, errors.New("unexpected "+t.val)
+}
+
+// ParseQuery parses a search query; nil if q is empty.
+func ParseQuery(q string) (Expr, error) {
+	toks, err := lex(q)
+	if err != nil || len(toks) == 0 {
+		return nil, err
+	}
+
+	p := &parser{ toks, 0 }
+	x, err := p.or()
+	if err == nil && p.pos < len(p.toks) {
+		err = errors.New("unexpected "+p.toks[p.pos].val)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return x, nil
+}
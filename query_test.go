@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var parsetests = []struct {
+	query	string
+	expr	string	// Expr.String(); empty if invalid
+}{
+	{ "", "" },
+	{ "physics", "physics" },
+	{ "physics maths", "(physics AND maths)" },
+	{ "physics, maths", "(physics AND maths)" },
+	{ "physics AND maths", "(physics AND maths)" },
+	{ "physics OR maths papers", "(physics OR (maths AND papers))" },
+	{ "-reddit", "NOT reddit" },
+	{ "NOT reddit", "NOT reddit" },
+	{ "a-b", "a-b" },
+	{ "or and not", "((or AND and) AND not)" },
+	{
+		"programming -reddit (physics OR maths)",
+		"((programming AND NOT reddit) AND (physics OR maths))",
+	},
+	{ "-(a OR b)", "NOT (a OR b)" },
+	{ `"quoted tag" "(a)" "a \"b\""`, `((quoted tag AND (a)) AND a "b")` },
+	{ "/r/ -/r/", "(/r/ AND NOT /r/)" },
+	{ "text:gopher", `text:"gopher"` },
+	{ `physics text:"go channels"`, `(physics AND text:"go channels")` },
+	{ `-text:go OR a`, `(NOT text:"go" OR a)` },
+	{ "after:2024-01-01", "after:2024-01-01T00:00:00Z" },
+	{ "a before:2024-01-01T10:00:00+02:00", "(a AND before:2024-01-01T08:00:00Z)" },
+	{ "updated-after:2024-01-01 -updated-before:2024-02-01",
+		"(updated-after:2024-01-01T00:00:00Z AND NOT updated-before:2024-02-01T00:00:00Z)" },
+	{ `"after:x"`, "after:x" },
+	{ "after:", "" },
+	{ "after:2024-13-01", "" },
+	{ "text:", "" },
+	{ `text:"..."`, "" },
+	{ "(a", "" },
+	{ "a)", "" },
+	{ "a OR", "" },
+	{ "-", "" },
+	{ `"a`, "" },
+	{ "()", "" },
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, test := range parsetests {
+		e, err := ParseQuery(test.query)
+		switch {
+		case test.expr == "" && test.query != "" && err == nil:
+			t.Error("Invalid query parsed:", test.query, e)
+		case test.expr != "" && err != nil:
+			t.Error("Cannot parse:", test.query, err)
+		case test.expr != "" && e.String() != test.expr:
+			t.Error("Bad parse:", test.query, e, test.expr)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	d := &Doc{ Id : -1, Name : "Go channels", Type : "text",
+		Content : "Gophers love channels.", Uid : 1, Tags : []string{ "bookmarks", "programming", "physics", "science/physics/quantum", "/r/" },
+		Created : time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		Updated : time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+
+	for q, ok := range map[string]bool{
+		"programming -reddit (physics OR maths)"	:	true,
+		"programming reddit"						:	false,
+		"maths OR -physics"							:	false,
+		"NOT (maths OR reddit)"						:	true,
+		"text:channels"								:	true,
+		`text:"GO gophers" programming`				:	true,
+		"text:gopher"								:	false,
+		"-text:love"								:	false,
+		"after:2024-01-01 before:2024-01-02"		:	true,
+		"after:2024-01-02"							:	false,
+		"before:2024-01-01T12:00:00Z"				:	false,
+		"updated-after:2024-03-01 programming"		:	true,
+		"updated-before:2024-03-01"					:	false,
+		"science"									:	true,
+		"science/physics -programming"				:	false,
+		"science/phys"								:	false,
+		"physics/quantum"							:	false,
+		"/r/"										:	true,
+		"/r"										:	false,
+	} {
+		e, err := ParseQuery(q)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		if e.Match(d) != ok {
+			t.Error("Bad match:", q)
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	e, err := ParseQuery(`text:"Go channels" -text:java (a OR text:gophers)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws := strings.Join(Terms(e), " "); ws != "go channels gophers" {
+		t.Error("Bad terms:", ws)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+// Remote authentication: an external service (-authserver)
+// manages accounts and tokens. It answers to
+//	/api/login?login=...	"ok" (login is a valid token),
+//							"new" (a token has been sent to
+//							the user) or "ko"
+//	/api/chain?token=...	a new token, or "ko"
+//	/api/info?token=...		user data; uid on first line
+//	/api/logout?token=...
+// Requests are authenticated with a shared key (-authkey).
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type RemoteAuth struct {
+	Client	*http.Client
+	server	string
+	key		string
+}
+
+// NewRemoteAuth uses the auth server at url, whose certificate
+// is in file cert; no certificate if cert is empty.
+func NewRemoteAuth(server, key, cert string) (*RemoteAuth, error) {
+	if key == "" {
+		return nil, errors.New("no key for the auth server (-authkey)")
+	}
+
+	a := &RemoteAuth{ &http.Client{}, strings.TrimSuffix(server, "/"), key }
+	if cert == "" {
+		return a, nil
+	}
+
+	// load auth certificate
+	pem, err := ioutil.ReadFile(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := x509.NewCertPool()
+	if !certs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("can't add "+cert)
+	}
+
+	// create Client for auth requests
+	a.Client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: certs,
+			},
+		},
+	}
+
+	return a, nil
+}
+
+func (a *RemoteAuth) mkr(descr, arg, val string) (string, error) {
+	resp, err := a.Client.Get(a.server+"/api/"+descr+"?"+arg+"="+
+		url.QueryEscape(val)+"&key="+url.QueryEscape(a.key))
+	// XXX make sure err doesn't embed sensible data (eg. key…)
+	if err != nil { return "", err }
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil { return "", err }
+
+	return string(body), nil
+}
+
+func (a *RemoteAuth) Form() string {
+	return "templates/login.html"
+}
+
+// login may be email, name or token
+func (a *RemoteAuth) Login(r *http.Request) (string, int32, error) {
+	login := r.FormValue("login")
+
+	resp, err := a.mkr("login", "login", login)
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch resp {
+	// received a valid token, effectively login the user
+	case "ok":
+		// fetch id from server
+		udata, err := a.mkr("info", "token", login)
+		if err != nil {
+			return "", 0, err
+		}
+		uid, err := strconv.ParseInt(strings.Split(udata, "\n")[0], 10, 32)
+		if err != nil {
+			return "", 0, err
+		}
+
+		// generate a new token
+		token, err := a.Chain(login)
+		return token, int32(uid), err
+	// new token has been generated
+	case "new":
+		return "", 0, ErrNewToken
+	}
+
+	// wrong data.
+	return "", 0, ErrBadLogin
+}
+
+func (a *RemoteAuth) Chain(token string) (string, error) {
+	token, err := a.mkr("chain", "token", token)
+	if err == nil && token == "ko" {
+		err = errors.New("bad token")
+	}
+	return token, err
+}
+
+func (a *RemoteAuth) Logout(token string) {
+	a.mkr("logout", "token", token)
+}
@@ -0,0 +1,172 @@
+package main
+
+// Optional server-side sessions (-sessions): the cookie only
+// holds a session id, the auth token stays on the server. Users
+// can list and revoke their sessions from the settings page, and
+// logging out invalidates the session for good. Sessions unused
+// for long are expired (-sessionttl).
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Sessions interface {
+	AddSession(s *Session) error
+	GetSession(id string) (Session, error)
+	UpdateSession(s *Session) error
+	GetSessions(uid int32) ([]Session, error)
+	DelSession(id string, uid int32) error
+	// delete sessions last seen before t; returns their number
+	ExpireSessions(t time.Time) (int64, error)
+}
+
+// session store, nil if disabled
+var sessions Sessions
+
+// NewSessions returns the session store named name: "memory",
+// "db" (the Store), or nil for "".
+func NewSessions(name string, st Store) (Sessions, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "memory":
+		return NewMemSessions(), nil
+	case "db":
+		if ss, ok := st.(Sessions); ok {
+			return ss, nil
+		}
+	}
+	return nil, errors.New("unknown session store: "+name)
+}
+
+func newSid() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// touchSession updates the session of r's cookie with token,
+// or creates a new session; returns the session id.
+func touchSession(r *http.Request, token string, uid int32) (string, error) {
+	if sid := cookieSid(r); sid != "" {
+		if s, err := sessions.GetSession(sid); err == nil && s.Uid == uid {
+			s.Token, s.Seen = token, time.Now()
+			return sid, sessions.UpdateSession(&s)
+		}
+	}
+
+	sid, err := newSid()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return sid, sessions.AddSession(&Session{
+		Id		:	sid,
+		Uid		:	uid,
+		Token	:	token,
+		Agent	:	r.UserAgent(),
+		Addr	:	r.RemoteAddr,
+		Created	:	now,
+		Seen	:	now,
+	})
+}
+
+// token and uid of session sid
+func sessionToken(sid string) (string, int32, error) {
+	if sessions == nil {
+		return "", 0, errors.New("sessions are disabled")
+	}
+
+	s, err := sessions.GetSession(sid)
+	if err != nil {
+		return "", 0, errors.New("no such session")
+	}
+	return s.Token, s.Uid, nil
+}
+
+type MemSessions struct {
+	mu			sync.Mutex
+	sessions	map[string]*Session
+}
+
+func NewMemSessions() *MemSessions {
+	return &MemSessions{ sessions : make(map[string]*Session) }
+}
+
+func (m *MemSessions) AddSession(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := *s
+	m.sessions[s.Id] = &c
+	return nil
+}
+
+func (m *MemSessions) GetSession(id string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[id]; ok {
+		return *s, nil
+	}
+	return Session{}, ErrNotFound
+}
+
+func (m *MemSessions) UpdateSession(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[s.Id]; !ok {
+		return ErrNotFound
+	}
+	c := *s
+	m.sessions[s.Id] = &c
+	return nil
+}
+
+func (m *MemSessions) GetSessions(uid int32) (ss []Session, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		if s.Uid == uid {
+			ss = append(ss, *s)
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Seen.After(ss[j].Seen) })
+
+	return
+}
+
+func (m *MemSessions) DelSession(id string, uid int32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.sessions[id]; !ok || s.Uid != uid {
+		return ErrNotFound
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemSessions) ExpireSessions(t time.Time) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.sessions {
+		if s.Seen.Before(t) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var stmpl = template.Must(
+	template.New("settings.html").ParseFiles("templates/settings.html"))
+
+// text documents formatters, implemented in style.css
+// (.format-<name>); the first one is the default.
+var formatters = []string{ "plain", "pre", "lines" }
+
+func validFormat(f string) bool {
+	for _, x := range formatters {
+		if x == f {
+			return true
+		}
+	}
+	return false
+}
+
+// read preferences from r's form
+func readPrefs(r *http.Request) (*Prefs, error) {
+	p := &Prefs{
+		Tags	:	splitTags(r.FormValue("tags")),
+		Search	:	strings.TrimSpace(r.FormValue("search")),
+		Public	:	r.FormValue("public") != "",
+		Format	:	r.FormValue("format"),
+	}
+
+	if _, err := ParseQuery(p.Search); err != nil {
+		return nil, errors.New("Bad default search: "+err.Error())
+	}
+
+	n, err := strconv.Atoi(r.FormValue("pagesize"))
+	if err != nil || n < 0 {
+		return nil, errors.New("Page size must be a positive number (0 for all)")
+	}
+	p.PageSize = n
+
+	if !validFormat(p.Format) {
+		return nil, errors.New("Unknown formatter: "+p.Format)
+	}
+
+	return p, nil
+}
+
+// account settings: preferences, active sessions
+func settings(w http.ResponseWriter, r *http.Request, uid int32) {
+	var err error
+
+	d := struct {
+		Prefs		Prefs
+		Formatters	[]string
+		Saved		bool
+		Enabled		bool		// server-side sessions
+		Sessions	[]Session
+		Current		string		// current session id
+		Error		error
+		Csrf		string
+	}{
+		Formatters	:	formatters,
+		Enabled		:	sessions != nil,
+		Current		:	cookieSid(r),
+		Csrf		:	csrfToken(r),
+	}
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "prefs":
+			var p *Prefs
+			// bad preferences are reported as such
+			if p, err = readPrefs(r); err == nil {
+				if err = db.SetPrefs(uid, p); err != nil {
+					err = userError(err)
+				}
+			}
+			d.Saved = err == nil
+		case "revoke":
+			if d.Enabled {
+				if err = sessions.DelSession(r.FormValue("id"), uid); err != nil {
+					err = userError(err)
+				}
+			}
+		}
+	}
+
+	d.Error = err
+	if d.Prefs, err = db.GetPrefs(uid); err != nil {
+		d.Error = userError(err)
+	}
+	if d.Prefs.Format == "" {
+		d.Prefs.Format = formatters[0]
+	}
+
+	if d.Enabled {
+		if d.Sessions, err = sessions.GetSessions(uid); err != nil {
+			d.Error = userError(err)
+		}
+	}
+
+	if err := stmpl.Execute(w, &d); err != nil {
+		LogHttp(w, err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+// SQLite backend, for single-user/laptop deployments: no
+// server nor role to set up, the database is a single file.
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"github.com/mattn/go-sqlite3"
+	"regexp"
+	"strings"
+)
+
+var sqlite = &dialect{
+	driver		:	"sqlite3_tags",
+	dsn			:	sqliteDSN,
+	migrations	:	sqliteMigrations,
+	tagsagg		:	`group_concat(tags.name, char(31))`,
+	rebind		:	sqliteRebind,
+	text		:	sqliteText,
+	rank		:	sqliteRank,
+}
+
+// sqlite3 driver, with our SQL functions
+func init() {
+	sql.Register("sqlite3_tags", &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			return c.RegisterFunc("tagsrank", ftsrank, true)
+		},
+	})
+}
+
+// default SQLite database file
+const sqlitedsn = "tags.db"
+
+// OpenSQLite opens (creates if needed) the SQLite database
+// stored in file path.
+func OpenSQLite(path string) (*Database, error) {
+	return initDB(sqlite, path)
+}
+
+func sqliteDSN(path string) string {
+	if path == "" {
+		path = sqlitedsn
+	}
+
+	// foreign keys are needed for ON DELETE CASCADE; transactions
+	// read before writing, and a deferred one can't wait for the
+	// write lock (SQLITE_BUSY, regardless of the busy timeout)
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path+sep+"_foreign_keys=1&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+}
+
+var placeholder = regexp.MustCompile(`\$([0-9]+)`)
+
+// $n are named parameters for SQLite, numbered by order
+// of appearance; ?n are bound by position, like $n in PostgreSQL.
+func sqliteRebind(q string) string {
+	return placeholder.ReplaceAllString(q, "?$1")
+}
+
+// FTS4 query for ws, joined by op; words are quoted so
+// that they aren't taken as FTS operators.
+func ftsquery(ws []string, op string) string {
+	qs := make([]string, len(ws))
+	for i, w := range ws {
+		qs[i] = `"`+w+`"`
+	}
+	return strings.Join(qs, op)
+}
+
+func sqliteText(ws []string, args *[]interface{}) string {
+	return `docs.id IN (SELECT docid FROM docsfts
+			WHERE docsfts MATCH `+arg(args, ftsquery(ws, " "))+`)`
+}
+
+// matchinfo() is only available to the MATCH query itself,
+// which FTS4 can't restrict to a single docid: ranks are joined.
+func sqliteRank(ws []string, args *[]interface{}) (string, string) {
+	return `LEFT JOIN (SELECT docid, tagsrank(matchinfo(docsfts, 'pcx')) AS rank
+			FROM docsfts WHERE docsfts MATCH `+arg(args, ftsquery(ws, " OR "))+`)
+			AS ftsrank ON ftsrank.docid = docs.id`, `coalesce(ftsrank.rank, 0)`
+}
+
+// ftsrank computes relevance from FTS4's matchinfo 'pcx': for
+// every (phrase, column), hits in the row, hits in all rows and
+// number of rows with hits. Rarer words weigh more.
+func ftsrank(mi []byte) float64 {
+	if len(mi) < 8 {
+		return 0
+	}
+	u := func(i int) float64 {
+		return float64(binary.NativeEndian.Uint32(mi[4*i:]))
+	}
+
+	r := 0.
+	p, c := int(u(0)), int(u(1))
+	for i := 0; i < p*c && 4*(2+3*i+2) <= len(mi); i++ {
+		hits, all := u(2+3*i), u(2+3*i+1)
+		if all > 0 {
+			r += hits/all
+		}
+	}
+	return r
+}
+
+// SQLite schema versions. The CHECK on docs.type stands for
+// PostgreSQL's dtype enum; new types require to rebuild docs.
+var sqliteMigrations = []migration{
+	// 1: initial schema
+	{
+		up : `
+			CREATE TABLE IF NOT EXISTS
+			docs(
+				id			INTEGER		PRIMARY KEY AUTOINCREMENT,
+				name		TEXT,
+				type		TEXT		CHECK (type IN ('text', 'url', 'pdf', 'ps')),
+				content		TEXT,
+				uid			INT
+			);
+
+			CREATE TABLE IF NOT EXISTS
+			tags(
+				id			INTEGER		PRIMARY KEY AUTOINCREMENT,
+				name		TEXT		UNIQUE
+			);
+
+			CREATE TABLE IF NOT EXISTS
+			tagsdocs(
+				idtag		INTEGER	REFERENCES	tags(id)	ON DELETE CASCADE,
+				iddoc		INTEGER	REFERENCES	docs(id)	ON DELETE CASCADE
+			);
+		`,
+		down : `
+			DROP TABLE tagsdocs;
+			DROP TABLE tags;
+			DROP TABLE docs;
+		`,
+	},
+	// 2: index the association table
+	{
+		up : `
+			CREATE INDEX tagsdocs_iddoc ON tagsdocs(iddoc);
+			CREATE INDEX tagsdocs_idtag ON tagsdocs(idtag);
+		`,
+		down : `
+			DROP INDEX tagsdocs_iddoc;
+			DROP INDEX tagsdocs_idtag;
+		`,
+	},
+	// 3: full-text search, docsfts mirrors docs
+	{
+		up : `
+			CREATE VIRTUAL TABLE docsfts USING fts4(name, content, tokenize=unicode61);
+			INSERT INTO docsfts(docid, name, content) SELECT id, name, content FROM docs;
+
+			CREATE TRIGGER docs_fts_insert AFTER INSERT ON docs BEGIN
+				INSERT INTO docsfts(docid, name, content)
+					VALUES (new.id, new.name, new.content);
+			END;
+			CREATE TRIGGER docs_fts_update AFTER UPDATE OF name, content ON docs BEGIN
+				UPDATE docsfts SET name = new.name, content = new.content
+					WHERE docid = new.id;
+			END;
+			CREATE TRIGGER docs_fts_delete AFTER DELETE ON docs BEGIN
+				DELETE FROM docsfts WHERE docid = old.id;
+			END;
+		`,
+		down : `
+			DROP TRIGGER docs_fts_insert;
+			DROP TRIGGER docs_fts_update;
+			DROP TRIGGER docs_fts_delete;
+			DROP TABLE docsfts;
+		`,
+	},
+	// 4: API tokens
+	{
+		up : `
+			CREATE TABLE tokens(
+				id			INTEGER		PRIMARY KEY AUTOINCREMENT,
+				uid			INT			NOT NULL,
+				name		TEXT,
+				hash		TEXT		NOT NULL	UNIQUE,
+				scope		TEXT		NOT NULL	CHECK (scope IN ('read', 'write')),
+				created		TIMESTAMP	NOT NULL	DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		down : `DROP TABLE tokens;`,
+	},
+	// 5: local accounts
+	{
+		up : `
+			CREATE TABLE users(
+				id			INTEGER		PRIMARY KEY AUTOINCREMENT,
+				name		TEXT		NOT NULL	UNIQUE,
+				hash		TEXT		NOT NULL,
+				created		TIMESTAMP	NOT NULL	DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		down : `DROP TABLE users;`,
+	},
+	// 6: server-side sessions
+	{
+		up : `
+			CREATE TABLE sessions(
+				id			TEXT		PRIMARY KEY,
+				uid			INT			NOT NULL,
+				token		TEXT,
+				agent		TEXT,
+				addr		TEXT,
+				created		TIMESTAMP	NOT NULL,
+				seen		TIMESTAMP	NOT NULL
+			);
+			CREATE INDEX sessions_uid ON sessions(uid);
+		`,
+		down : `DROP TABLE sessions;`,
+	},
+	// 7: per-user preferences
+	{
+		up : `
+			CREATE TABLE prefs(
+				uid			INT			PRIMARY KEY,
+				tags		TEXT		NOT NULL DEFAULT '',
+				search		TEXT		NOT NULL DEFAULT '',
+				pagesize	INT			NOT NULL DEFAULT 0,
+				public		BOOLEAN		NOT NULL DEFAULT 0,
+				format		TEXT		NOT NULL DEFAULT ''
+			);
+		`,
+		down : `DROP TABLE prefs;`,
+	},
+	// 8: creation and modification dates, stored in UTC as
+	// formatted by go-sqlite3, so that they compare as strings
+	{
+		up : `
+			ALTER TABLE docs ADD COLUMN created TIMESTAMP NOT NULL
+				DEFAULT '1970-01-01 00:00:00+00:00';
+			ALTER TABLE docs ADD COLUMN updated TIMESTAMP NOT NULL
+				DEFAULT '1970-01-01 00:00:00+00:00';
+			UPDATE docs SET
+				created = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now'),
+				updated = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now');
+			CREATE INDEX docs_created ON docs(created);
+			CREATE INDEX docs_updated ON docs(updated);
+		`,
+		down : `
+			DROP INDEX docs_created;
+			DROP INDEX docs_updated;
+			ALTER TABLE docs DROP COLUMN created;
+			ALTER TABLE docs DROP COLUMN updated;
+		`,
+	},
+	// 9: revisions: documents' past versions
+	{
+		up : `
+			CREATE TABLE revisions(
+				id			INTEGER		PRIMARY KEY AUTOINCREMENT,
+				iddoc		INTEGER		NOT NULL	REFERENCES docs(id)	ON DELETE CASCADE,
+				name		TEXT,
+				type		TEXT,
+				content		TEXT,
+				tags		TEXT,
+				created		TIMESTAMP	NOT NULL,
+				saved		TIMESTAMP	NOT NULL
+			);
+			CREATE INDEX revisions_iddoc ON revisions(iddoc);
+		`,
+		down : `DROP TABLE revisions;`,
+	},
+	// 10: trash: deleted documents, until purged
+	{
+		up : `
+			ALTER TABLE docs ADD COLUMN deleted TIMESTAMP;
+			CREATE INDEX docs_deleted ON docs(deleted);
+		`,
+		down : `
+			DELETE FROM docs WHERE deleted IS NOT NULL;
+			DROP INDEX docs_deleted;
+			ALTER TABLE docs DROP COLUMN deleted;
+		`,
+	},
+	// 11: per-user tags, cf. PostgreSQL's; UNIQUE can't be
+	// altered, so tags (and tagsdocs, which references it)
+	// are rebuilt.
+	{
+		up : `
+			CREATE TABLE tagsnew(
+				id			INTEGER		PRIMARY KEY AUTOINCREMENT,
+				uid			INT			NOT NULL	DEFAULT 0,
+				name		TEXT,
+				UNIQUE (uid, name)
+			);
+			CREATE TABLE tagsdocsnew(
+				idtag		INTEGER	REFERENCES	tagsnew(id)	ON DELETE CASCADE,
+				iddoc		INTEGER	REFERENCES	docs(id)	ON DELETE CASCADE
+			);
+
+			INSERT INTO tagsnew(id, uid, name)
+				SELECT id, 0, name FROM tags WHERE name LIKE ':%';
+			INSERT INTO tagsnew(uid, name)
+				SELECT DISTINCT coalesce(docs.uid, 0), tags.name
+				FROM tags, tagsdocs, docs
+				WHERE tagsdocs.idtag = tags.id
+				AND tagsdocs.iddoc = docs.id
+				AND tags.name NOT LIKE ':%';
+			INSERT INTO tagsdocsnew(idtag, iddoc)
+				SELECT tagsnew.id, tagsdocs.iddoc
+				FROM tagsdocs, tags, docs, tagsnew
+				WHERE tags.id = tagsdocs.idtag
+				AND docs.id = tagsdocs.iddoc
+				AND tagsnew.name = tags.name
+				AND tagsnew.uid = CASE WHEN tags.name LIKE ':%' THEN 0 ELSE coalesce(docs.uid, 0) END;
+
+			DROP TABLE tagsdocs;
+			DROP TABLE tags;
+			ALTER TABLE tagsnew RENAME TO tags;
+			ALTER TABLE tagsdocsnew RENAME TO tagsdocs;
+			CREATE INDEX tagsdocs_iddoc ON tagsdocs(iddoc);
+			CREATE INDEX tagsdocs_idtag ON tagsdocs(idtag);
+		`,
+		down : `
+			CREATE TABLE tagsold(
+				id			INTEGER		PRIMARY KEY AUTOINCREMENT,
+				name		TEXT		UNIQUE
+			);
+			CREATE TABLE tagsdocsold(
+				idtag		INTEGER	REFERENCES	tagsold(id)	ON DELETE CASCADE,
+				iddoc		INTEGER	REFERENCES	docs(id)	ON DELETE CASCADE
+			);
+
+			INSERT INTO tagsold(id, name)
+				SELECT min(id), name FROM tags GROUP BY name;
+			INSERT INTO tagsdocsold(idtag, iddoc)
+				SELECT tagsold.id, tagsdocs.iddoc
+				FROM tagsdocs, tags, tagsold
+				WHERE tags.id = tagsdocs.idtag
+				AND tagsold.name = tags.name;
+
+			DROP TABLE tagsdocs;
+			DROP TABLE tags;
+			ALTER TABLE tagsold RENAME TO tags;
+			ALTER TABLE tagsdocsold RENAME TO tagsdocs;
+			CREATE INDEX tagsdocs_iddoc ON tagsdocs(iddoc);
+			CREATE INDEX tagsdocs_idtag ON tagsdocs(idtag);
+		`,
+	},
+	// 12: local accounts' login tokens
+	{
+		up : `
+			CREATE TABLE logins(
+				hash		TEXT		PRIMARY KEY,
+				uid			INT			NOT NULL	REFERENCES users(id)	ON DELETE CASCADE,
+				created		TIMESTAMP	NOT NULL	DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		down : `DROP TABLE logins;`,
+	},
+}
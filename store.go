@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Store holds documents and their tags. Handlers only
+// talk to a Store, so that backends may be swapped.
+type Store interface {
+	// Errors are ErrNotFound, ErrForbidden, ErrInvalidType
+	// (cf. errors.go), possibly wrapped, or storage failures.
+
+	// nil if document id belongs to uid, ErrForbidden if
+	// it belongs to someone else
+	CheckOwner(id, uid int32) error
+
+	// fetch a (live) document
+	GetDoc(id int32) (Doc, error)
+
+	// documents readable by uid matching q (cf. query.go);
+	// all uid's documents if q is nil; p selects the sort
+	// order and page, and gets the next page's cursor (cf. page.go)
+	GetDocs(uid int32, q Expr, p *Page) ([]Doc, error)
+
+	// Mutations are atomic: on error, nothing is changed.
+
+	// add a document; returns its id, or -1 and an error
+	AddDoc(d *Doc) (int32, error)
+
+	// update a document, saving its previous version
+	UpdateDoc(d *Doc) error
+
+	// move a document to the trash (cf. trash.go); trashed
+	// documents are only reachable through the methods below
+	DelDoc(id int32) error
+	GetTrash(uid int32) ([]Trashed, error)
+	RestoreDoc(id, uid int32) error
+	PurgeDoc(id, uid int32) error
+	// purge documents trashed before t; returns their number
+	Expire(t time.Time) (int64, error)
+
+	// past versions of document id, newest first (cf. history.go)
+	GetRevisions(id int32) ([]Revision, error)
+	GetRevision(rid int32) (Revision, error)
+
+	// tags used by uid, by name
+	GetTags(uid int32) ([]Tag, error)
+	// retag uid's documents (trashed included) tagged by one
+	// of from with to, and drop from; descendants of from are
+	// moved under to. Renames a tag, or merges tags (cf.
+	// tagpage.go)
+	MergeTags(uid int32, from []string, to string) error
+	// untag uid's documents (trashed included) tagged name;
+	// ErrNotFound if there are none
+	DelTag(uid int32, name string) error
+
+	// API tokens, identified by hash (cf. tokens.go)
+	AddToken(t *Token, hash string) (int32, error)
+	GetToken(hash string) (Token, error)
+	GetTokens(uid int32) ([]Token, error)
+	DelToken(id, uid int32) error
+
+	// local accounts (cf. local.go)
+	AddUser(name, hash string) (int32, error)
+	GetUser(name string) (User, error)
+	// their login tokens, identified by hash
+	AddLogin(uid int32, hash string) error
+	GetLogin(hash string) (int32, error)
+	DelLogin(hash string) error
+
+	// preferences; zero Prefs if never set
+	GetPrefs(uid int32) (Prefs, error)
+	SetPrefs(uid int32, p *Prefs) error
+}
+
+// Available backends, by name; the argument is a backend
+// specific data source (eg. PostgreSQL connection string).
+var stores = map[string]func(string) (Store, error){
+	"postgres": func(dsn string) (Store, error) {
+		db, err := OpenDB(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	},
+	"sqlite": func(dsn string) (Store, error) {
+		db, err := OpenSQLite(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	},
+	"memory": func(string) (Store, error) {
+		return NewMemStore(), nil
+	},
+}
+
+// OpenStore opens the backend named name; an empty dsn
+// selects the backend's default.
+func OpenStore(name, dsn string) (Store, error) {
+	open, ok := stores[name]
+	if !ok {
+		return nil, errors.New("unknown backend: "+name)
+	}
+	return open(dsn)
+}
@@ -0,0 +1,215 @@
+package main
+
+// Tag to id cache, shared by the HTTP handlers of a Database;
+// tags are keyed by owner and name (cf. tagOwner). It is
+// bounded, evicting the least recently used tags, and tags
+// renamed or deleted must be invalidated. With -tagnotify,
+// PostgreSQL backends broadcast invalidations to other
+// processes using the same database (LISTEN/NOTIFY).
+//
+// Transactions cache the tags they create once committed,
+// unless some tag was invalidated since they began: their ids
+// may be stale by then (cf. Commit).
+
+import (
+	"container/list"
+	"github.com/lib/pq"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PostgreSQL channel carrying invalidated tag names
+const tagchannel = "tags_invalidate"
+
+type tagCache struct {
+	sync.Mutex
+	size	int
+	lru		*list.List		// of *tagEntry, most recent first
+	tags	map[tagKey]*list.Element
+	gen		uint64		// bumped by invalidations
+}
+
+type tagKey struct {
+	uid		int32
+	name	string
+}
+
+type tagEntry struct {
+	tagKey
+	id		int32
+}
+
+func newTagCache(size int) *tagCache {
+	return &tagCache{ size : size, lru : list.New(), tags : make(map[tagKey]*list.Element) }
+}
+
+// as sent to other processes: uid/name
+func (k tagKey) String() string {
+	return strconv.Itoa(int(k.uid))+"/"+k.name
+}
+
+func parseTagKey(s string) (k tagKey, ok bool) {
+	uid, name, ok := strings.Cut(s, "/")
+	if !ok {
+		return k, false
+	}
+	i, err := strconv.ParseInt(uid, 10, 32)
+	return tagKey{ int32(i), name }, err == nil
+}
+
+func (c *tagCache) Get(k tagKey) (int32, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.tags[k]
+	if !ok {
+		return -1, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*tagEntry).id, true
+}
+
+func (c *tagCache) Put(k tagKey, id int32) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.put(k, id)
+}
+
+func (c *tagCache) put(k tagKey, id int32) {
+	if c.size <= 0 {
+		return
+	}
+	if e, ok := c.tags[k]; ok {
+		e.Value.(*tagEntry).id = id
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.tags[k] = c.lru.PushFront(&tagEntry{ k, id })
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		delete(c.tags, e.Value.(*tagEntry).tagKey)
+		c.lru.Remove(e)
+	}
+}
+
+// Forget drops ks from the cache.
+func (c *tagCache) Forget(ks ...tagKey) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.forget(ks)
+}
+
+func (c *tagCache) forget(ks []tagKey) {
+	if len(ks) > 0 {
+		c.gen++
+	}
+	for _, k := range ks {
+		if e, ok := c.tags[k]; ok {
+			delete(c.tags, k)
+			c.lru.Remove(e)
+		}
+	}
+}
+
+// Reset empties the cache.
+func (c *tagCache) Reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.gen++
+	c.lru.Init()
+	c.tags = make(map[tagKey]*list.Element)
+}
+
+// Gen is the current generation, for Commit.
+func (c *tagCache) Gen() uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.gen
+}
+
+// Commit forgets ks, and caches tags unless the cache was
+// invalidated since generation gen.
+func (c *tagCache) Commit(gen uint64, ks []tagKey, tags map[tagKey]int32) {
+	c.Lock()
+	defer c.Unlock()
+
+	stale := c.gen != gen
+	c.forget(ks)
+	if stale {
+		return
+	}
+	for k, id := range tags {
+		if id > 0 {
+			c.put(k, id)
+		}
+	}
+}
+
+func (c *tagCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
+
+// invalidate ks once tx commits, here and, with -tagnotify,
+// in other processes.
+func (tx *Tx) invalidate(ks ...tagKey) error {
+	tx.forget = append(tx.forget, ks...)
+	for _, k := range ks {
+		tx.tags[k] = 0
+	}
+	if !tx.db.notify {
+		return nil
+	}
+	for _, k := range ks {
+		if _, err := tx.Exec(`SELECT pg_notify($1, $2)`, tagchannel, k.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen forgets the tags invalidated by other processes;
+// the whole cache is dropped if notifications may have been
+// missed (eg. reconnection).
+func (db *Database) listen(dsn string) error {
+	l := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("tag cache listener:", err)
+		}
+	})
+	if err := l.Listen(tagchannel); err != nil {
+		l.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case n := <-l.Notify:
+				var k tagKey
+				ok := false
+				if n != nil {
+					k, ok = parseTagKey(n.Extra)
+				}
+				if ok {
+					db.tagcache.Forget(k)
+				} else {
+					db.tagcache.Reset()
+				}
+			case <-time.After(90*time.Second):
+				go l.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
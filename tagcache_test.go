@@ -0,0 +1,203 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// uid 1's tag name
+func k1(name string) tagKey {
+	return tagKey{ 1, name }
+}
+
+func TestTagCache(t *testing.T) {
+	c := newTagCache(2)
+
+	c.Put(k1("a"), 1)
+	c.Put(k1("b"), 2)
+	c.Get(k1("a"))
+	c.Put(k1("c"), 3)
+	if _, ok := c.Get(k1("b")); ok || c.Len() != 2 {
+		t.Error("Least recently used tag not evicted")
+	}
+	if id, ok := c.Get(k1("a")); !ok || id != 1 {
+		t.Error("Recently used tag evicted:", id)
+	}
+
+	c.Put(k1("a"), 4)
+	if id, _ := c.Get(k1("a")); id != 4 || c.Len() != 2 {
+		t.Error("Tag not updated:", id)
+	}
+
+	c.Forget(k1("a"), k1("nope"))
+	if _, ok := c.Get(k1("a")); ok || c.Len() != 1 {
+		t.Error("Tag not forgotten")
+	}
+	c.Reset()
+	if _, ok := c.Get(k1("c")); ok || c.Len() != 0 {
+		t.Error("Cache not reset")
+	}
+
+	// namespaces
+	c = newTagCache(10)
+	c.Put(k1("a"), 1)
+	c.Put(tagKey{ 2, "a" }, 2)
+	if id, _ := c.Get(tagKey{ 2, "a" }); id != 2 {
+		t.Error("Tags of different users mixed:", id)
+	}
+	for _, k := range []tagKey{ k1("a"), { 0, ":public" }, k1("a/b") } {
+		if k2, ok := parseTagKey(k.String()); !ok || k2 != k {
+			t.Error("Bad key round trip:", k, k2)
+		}
+	}
+	if _, ok := parseTagKey("nope"); ok {
+		t.Error("Bad key parsed")
+	}
+
+	c = newTagCache(0)
+	if c.Put(k1("a"), 1); c.Len() != 0 {
+		t.Error("Disabled cache filled")
+	}
+}
+
+// transactions overtaken by invalidations don't cache their tags
+func TestTagCacheGen(t *testing.T) {
+	c := newTagCache(10)
+	c.Put(k1("a"), 1)
+
+	gen := c.Gen()
+	c.Commit(gen, nil, map[tagKey]int32{ k1("b") : 2, k1("c") : 0 })
+	if id, _ := c.Get(k1("b")); id != 2 || c.Len() != 2 {
+		t.Error("Tags not committed:", id)
+	}
+
+	gen = c.Gen()
+	c.Forget(k1("b"))
+	c.Commit(gen, []tagKey{ k1("a") }, map[tagKey]int32{ k1("b") : 3 })
+	if _, ok := c.Get(k1("b")); ok {
+		t.Error("Stale tag cached")
+	}
+	if _, ok := c.Get(k1("a")); ok {
+		t.Error("Stale transaction's tag not forgotten")
+	}
+
+	gen = c.Gen()
+	c.Reset()
+	if c.Commit(gen, nil, map[tagKey]int32{ k1("b") : 3 }); c.Len() != 0 {
+		t.Error("Tag cached across reset")
+	}
+}
+
+// to be run with -race
+func TestTagCacheConcurrent(t *testing.T) {
+	c := newTagCache(10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				name := strconv.Itoa((i+j)%20)
+				c.Put(k1(name), int32(j))
+				c.Get(k1(name))
+				if j%100 == 0 {
+					c.Forget(k1(name))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c.Len() > 10 {
+		t.Error("Cache overflow:", c.Len())
+	}
+}
+
+func TestTagCacheTx(t *testing.T) {
+	testdb, err := OpenSQLite(filepath.Join(t.TempDir(), "tags.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testdb.Close()
+
+	mustAdd(t, testdb, &Doc{ Id : -1, Name : "x", Type : "text", Uid : 1, Tags : []string{"cached"} })
+	id, ok := testdb.tagcache.Get(k1("cached"))
+	if !ok {
+		t.Fatal("Created tag not cached")
+	}
+
+	// invalidations only apply once committed
+	testdb.inTx(func(tx *Tx) error {
+		tx.invalidate(k1("cached"))
+		return ErrNotFound
+	})
+	if _, ok := testdb.tagcache.Get(k1("cached")); !ok {
+		t.Error("Tag forgotten on rollback")
+	}
+	testdb.inTx(func(tx *Tx) error {
+		return tx.invalidate(k1("cached"))
+	})
+	if _, ok := testdb.tagcache.Get(k1("cached")); ok {
+		t.Error("Tag not forgotten")
+	}
+
+	// reloaded on demand
+	mustAdd(t, testdb, &Doc{ Id : -1, Name : "y", Type : "text", Uid : 1, Tags : []string{"cached"} })
+	if id2, ok := testdb.tagcache.Get(k1("cached")); !ok || id2 != id {
+		t.Error("Bad tag id:", id, id2)
+	}
+}
+
+// cached ids may outlive their tags (eg. deleted by another process)
+func TestTagCacheStale(t *testing.T) {
+	testdb, err := OpenSQLite(filepath.Join(t.TempDir(), "tags.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testdb.Close()
+
+	testdb.tagcache.Put(k1("x"), 42)
+	id := mustAdd(t, testdb, &Doc{ Id : -1, Name : "x", Type : "text", Uid : 1, Tags : []string{"x"} })
+	if d := docOf(testdb, id); len(d.Tags) != 1 || d.Tags[0] != "x" {
+		t.Error("Stale tag id not reloaded:", d.Tags)
+	}
+	if id, _ := testdb.tagcache.Get(k1("x")); id == 42 {
+		t.Error("Stale tag id still cached")
+	}
+
+	// deletions racing with additions
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*50)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var err error
+				if i%2 == 0 {
+					_, err = testdb.AddDoc(&Doc{ Id : -1, Name : "x", Type : "text",
+						Uid : 1, Tags : []string{"x"} })
+				} else if err = testdb.DelTag(1, "x"); err == ErrNotFound {
+					err = nil
+				}
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal("Concurrent add/delete failed:", err)
+		}
+	}
+
+	id = mustAdd(t, testdb, &Doc{ Id : -1, Name : "x", Type : "text", Uid : 1, Tags : []string{"x"} })
+	if d := docOf(testdb, id); len(d.Tags) != 1 || d.Tags[0] != "x" {
+		t.Error("Tag lost:", d.Tags)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+// Tag management: rename, merge and delete one's tags, on all
+// one's documents at once. Renaming a tag to an existing one
+// merges them; renaming a tag moves its descendants along
+// (cf. TagPathSep). System tags (eg. :public) are shared by
+// all users: they can only be deleted, ie. removed from one's
+// documents. Tags are listed as a tree.
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var tgtmpl = template.Must(
+	template.New("tags.html").ParseFiles("templates/tags.html"))
+
+// checkMerge validates merging tags from into to.
+func checkMerge(from []string, to string) error {
+	if len(from) == 0 || to == "" {
+		return ErrNoTags
+	}
+	if ts := splitTags(to); len(ts) != 1 || ts[0] != to {
+		return ErrBadTag
+	}
+	for _, t := range append(from, to) {
+		if isSystemTag(t) {
+			return ErrSystemTag
+		}
+	}
+	for _, f := range from {
+		if to != f && tagUnder(to, f) {
+			return ErrTagLoop
+		}
+	}
+	return nil
+}
+
+// mergedTag is tag, once from merged into to: the first of
+// from that tag is under is replaced by to.
+func mergedTag(tag string, from []string, to string) string {
+	for _, f := range from {
+		if tagUnder(tag, f) {
+			return to+tag[len(f):]
+		}
+	}
+	return tag
+}
+
+// sets found[i] if tag is under from[i]; a tag may be under
+// several (eg. a/b is under a and a/b).
+func markUnder(found []bool, tag string, from []string) {
+	for i, f := range from {
+		found[i] = found[i] || tagUnder(tag, f)
+	}
+}
+
+// A tag in a tag tree: Count is that of the tag itself, Total
+// includes its descendants.
+type TagNode struct {
+	Tag
+	Base		string		// last path element
+	Depth		int
+	Total		int
+}
+
+// tagTree returns the tree of tags ts, depth first, children
+// by name. Ancestors without documents are included.
+func tagTree(ts []Tag) []TagNode {
+	ns := make(map[string]*TagNode)
+	for _, t := range ts {
+		for name := t.Name; name != ""; name = tagParent(name) {
+			n, ok := ns[name]
+			if !ok {
+				n = &TagNode{ Tag : Tag{ Name : name }, Base : tagBase(name) }
+				for p := tagParent(name); p != ""; p = tagParent(p) {
+					n.Depth++
+				}
+				ns[name] = n
+			}
+			if name == t.Name {
+				n.Count = t.Count
+			}
+			n.Total += t.Count
+		}
+	}
+
+	// children sort right after their parent: names are keyed
+	// by their ancestors' names
+	tree := make([]TagNode, 0, len(ns))
+	keys := make(map[string]string, len(ns))
+	for name, n := range ns {
+		tree = append(tree, *n)
+		keys[name] = name
+		for p := tagParent(name); p != ""; p = tagParent(p) {
+			keys[name] = p+"\x00"+keys[name]
+		}
+	}
+	sort.Slice(tree, func(i, j int) bool {
+		return keys[tree[i].Name] < keys[tree[j].Name]
+	})
+	return tree
+}
+
+// list, rename, merge and delete one's tags
+func tagPage(w http.ResponseWriter, r *http.Request, uid int32) {
+	var err error
+	var info string
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		to := strings.TrimSpace(r.FormValue("to"))
+		switch r.FormValue("action") {
+		case "rename":
+			err = db.MergeTags(uid, []string{ r.FormValue("from") }, to)
+			info = "Tag renamed"
+		case "merge":
+			err = db.MergeTags(uid, r.Form["from"], to)
+			info = "Tags merged"
+		case "delete":
+			err = db.DelTag(uid, r.FormValue("from"))
+			info = "Tag deleted"
+		}
+		if err != nil {
+			err = errors.New("Cannot "+r.FormValue("action")+": "+userError(err).Error())
+			info = ""
+		}
+	}
+
+	ts, terr := db.GetTags(uid)
+	if terr != nil && err == nil {
+		err = userError(terr)
+	}
+
+	d := struct {
+		Tags		[]TagNode
+		Info		string
+		Error		error
+		Csrf		string
+	}{ Tags : tagTree(ts), Info : info, Error : err, Csrf : csrfToken(r) }
+
+	if err := tgtmpl.Execute(w, &d); err != nil {
+		LogHttp(w, err)
+	}
+}
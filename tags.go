@@ -1,28 +1,49 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"flag"
+	"html"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 var (
 	port = flag.String("port", "8082", "Listening HTTP port")
 	ssl = flag.Bool("ssl", true, "Use SSL")
-
-	db *Database
-	loginForm []byte
+	backend = flag.String("db", "postgres", "Storage backend (postgres, sqlite, memory)")
+	dsn = flag.String("dsn", "", "Backend data source (default depends on -db)")
+	automigrate = flag.Bool("automigrate", true, "Migrate the schema on startup")
+	authname = flag.String("auth", "remote", "Authentication (remote, local)")
+	authserver = flag.String("authserver", "https://localhost:8080/", "Remote auth server")
+	authkey = flag.String("authkey", os.Getenv("TAGS_AUTHKEY"),
+		"Remote auth server key (default $TAGS_AUTHKEY)")
+	keyfile = flag.String("keys", "cookie-keys", "Cookie keys file, created if needed")
+	sessname = flag.String("sessions", "", "Server-side sessions (memory, db; default none)")
+	sessionttl = flag.Duration("sessionttl", 30*24*time.Hour,
+		"Expire sessions unused for that long (0: never)")
+	retention = flag.Duration("retention", 30*24*time.Hour,
+		"Purge trashed documents after that long (0: never)")
+	tagcachesize = flag.Int("tagcache", 10000, "Maximum number of cached tags")
+	tagnotify = flag.Bool("tagnotify", false,
+		"Share tag cache invalidations between processes (postgres)")
+
+	db Store
+	loginForm *template.Template
 
 	ltmpl = template.Must(
 		template.New("login.html").ParseFiles("templates/login.html"))
 
+	rgtmpl = template.Must(
+		template.New("register.html").ParseFiles("templates/register.html"))
+
 	utmpl = template.Must(
 		template.New("user.html").Funcs(template.FuncMap{
 			"GetTags": func(tags []string) string {
@@ -40,6 +61,7 @@ var (
 			"GetURL" : func(url string) string {
 				return strings.SplitN(url, "\n", 2)[0]
 			},
+			"Snippet" : snippet,
 			"GetComment" : func(url string) string {
 				ret := strings.SplitN(url, "\n", 2)
 				if len(ret) == 2 {
@@ -64,6 +86,67 @@ func splitTags(tags string) []string {
 	})
 }
 
+// snippet returns an excerpt of s around the first of the
+// searched words ws, escaped, with searched words highlighted.
+func snippet(s string, ws []string) template.HTML {
+	type span struct {
+		beg, end	int
+		hit			bool
+	}
+	var spans []span
+
+	isw := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	beg := -1
+	for i, r := range s+" " {
+		switch {
+		case isw(r) && beg == -1:
+			beg = i
+		case !isw(r) && beg != -1:
+			spans, beg = append(spans, span{ beg, i, false }), -1
+		}
+	}
+
+	first := -1
+	for k := range spans {
+		w := strings.ToLower(s[spans[k].beg:spans[k].end])
+		for _, x := range ws {
+			if w == x {
+				spans[k].hit = true
+			}
+		}
+		if spans[k].hit && first == -1 {
+			first = k
+		}
+	}
+	if first == -1 {
+		return ""
+	}
+
+	a, b := first-8, first+24
+	if a < 0 { a = 0 }
+	if b > len(spans) { b = len(spans) }
+
+	res, pos := "", 0
+	if a > 0 {
+		res, pos = "…", spans[a].beg
+	}
+	for k := a; k < b; k++ {
+		res += html.EscapeString(s[pos:spans[k].beg])
+		w := html.EscapeString(s[spans[k].beg:spans[k].end])
+		if spans[k].hit {
+			w = "<mark>"+w+"</mark>"
+		}
+		res, pos = res+w, spans[k].end
+	}
+	if b < len(spans) {
+		res += "…"
+	} else {
+		res += html.EscapeString(s[pos:])
+	}
+
+	return template.HTML(res)
+}
+
 func getType(c string) string {
 	// XXX may regexp
 	// "^((f|ht)tps?:// | [A-Z]:\\ | /)"
@@ -87,65 +170,126 @@ func index(w http.ResponseWriter, r *http.Request, _ int32) {
 func login(w http.ResponseWriter, r *http.Request, _ int32) {
 	switch r.Method {
 	case "GET":
-		w.Write(loginForm)
-	case "POST":
-		// login may be email, name or token
-		login := r.FormValue("login")
-
-		resp, err := login2(login)
-		if err != nil {
+		d := struct{ Csrf string }{ csrfToken(r) }
+		if err := loginForm.Execute(w, &d); err != nil {
 			LogHttp(w, err)
-			return
 		}
+	case "POST":
+		token, uid, err := auth.Login(r)
 
-		switch resp {
-		// received a valid token, effectively login the user
-		case "ok":
-			// fetch id from server
-			udata, err := info(login)
-			if err != nil {
+		switch err {
+		case nil:
+			if err := setToken(w, r, token, uid); err != nil {
 				LogHttp(w, err)
 				return
 			}
-			uid, _ := strconv.ParseInt(strings.Split(udata, "\n")[0], 10, 32)
-
-			// generate a new token
-			token, _ := chain(login)
-			setToken(w, token, int32(uid))
-
 			// everything went well, redirect
 			http.Redirect(w, r, "/user/", http.StatusFound)
 		// wrong data.
-		case "ko":
-			SetError(w, errors.New("Wrong token/email/name"))
+		case ErrBadLogin:
+			SetError(w, err)
 			http.Redirect(w, r, "/login", http.StatusFound)
 		// new token has been generated
-		case "new":
-			SetInfo(w, "Check your AAS account!")
+		case ErrNewToken:
+			SetInfo(w, err.Error())
 			http.Redirect(w, r, "/login", http.StatusFound)
+		default:
+			LogHttp(w, err)
+		}
+	}
+}
+
+// create a local account, and log in
+func register(w http.ResponseWriter, r *http.Request, _ int32) {
+	reg, ok := auth.(Registerer)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		d := struct{ Csrf string }{ csrfToken(r) }
+		if err := rgtmpl.Execute(w, &d); err != nil {
+			LogHttp(w, err)
 		}
+	case "POST":
+		if _, err := reg.Register(r); err != nil {
+			SetError(w, err)
+			http.Redirect(w, r, "/register", http.StatusFound)
+			return
+		}
+		login(w, r, 0)
 	}
 }
 
 func logout(w http.ResponseWriter, r *http.Request, _ int32) {
 	// XXX can safely getToken() here as
 	// logout is not in mustauth
-	if token, _, err := getToken(r); err == nil {
-		logout2(token)
+	if token, uid, err := getToken(r); err == nil {
+		auth.Logout(token)
+		// getToken() succeeded: sessions are enabled if sid is set
+		if sid := cookieSid(r); sid != "" {
+			sessions.DelSession(sid, uid)
+		}
 		unsetToken(w)
 	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func user(w http.ResponseWriter, r *http.Request, uid int32) {
-	// fetch docs
-	docs := db.GetDocs(uid, splitTags(r.FormValue("search")))
+	var docs []Doc
+
+	prefs, err := db.GetPrefs(uid)
+	if err != nil {
+		LogError(err)
+	}
+	if prefs.Format == "" {
+		prefs.Format = formatters[0]
+	}
+
+	// fetch docs; default search unless one was submitted
+	search := r.FormValue("search")
+	if _, ok := r.Form["search"]; !ok {
+		search = prefs.Search
+	}
+	q, err := ParseQuery(search)
+	p, perr := readPage(r)
+	if err == nil && perr != nil {
+		err = perr
+	}
+	if err == nil {
+		p.Limit = prefs.PageSize
+		if docs, err = db.GetDocs(uid, q, p); err != nil {
+			err = userError(err)
+		}
+	}
+
+	// page navigation
+	var first, next string
+	v := url.Values{ "search" : {search}, "sort" : {p.Sort} }
+	if p.Cursor != "" {
+		first = "/user/?"+v.Encode()
+	}
+	if p.Next != "" {
+		v.Set("cursor", p.Next)
+		next = "/user/?"+v.Encode()
+	}
 
 	d := struct {
-		Empty Doc
-		Docs  []Doc
-		Uid   int32
-	}{Doc{uid, "", "", "Some content", -1, []string{""}}, docs, uid}
+		Empty  Doc
+		Docs   []Doc
+		Uid    int32
+		Search string
+		Sort   string
+		Error  error
+		Terms  []string
+		Csrf   string
+		First  string
+		Next   string
+		Format string
+	}{Doc{ Id : uid, Content : "Some content", Uid : -1, Tags : []string{""} }, docs, uid, search, p.Sort, err,
+		Terms(q), csrfToken(r), first, next, prefs.Format}
 
 	if err := utmpl.Execute(w, &d); err != nil {
 		LogHttp(w, err)
@@ -154,23 +298,41 @@ func user(w http.ResponseWriter, r *http.Request, uid int32) {
 }
 
 func add(w http.ResponseWriter, r *http.Request, uid int32) {
+	prefs, err := db.GetPrefs(uid)
+	if err != nil {
+		LogError(err)
+	}
+
 	name := r.FormValue("name")
 	tags := splitTags(r.FormValue("tags"))
-	// XXX element not added (can't be retrieved)
-	if len(tags) == 0 {
-		SetError(w, errors.New("At least one tag is required"))
-		http.Redirect(w, r, "/user/", http.StatusFound)
-		return
-	}
 
 	// XXX  remove  html content.
 	// (it should have been removed by js, but...)
 	content := strings.TrimSpace(r.FormValue("content"))
 	typ := getType(content)
 
-	id := db.AddDoc(&Doc{-1, name, typ, content, uid, tags})
-	if id == -1 {
-		SetError(w, errors.New("Can't add that (weird)"))
+	d := &Doc{ Id : -1, Name : name, Type : typ, Content : content, Uid : uid, Tags : tags }
+
+	// default tags and visibility
+	extra := prefs.Tags
+	if prefs.Public {
+		extra = append(extra, ":public")
+	}
+	for _, t := range extra {
+		if !hasTag(d, t) {
+			d.Tags = append(d.Tags, t)
+		}
+	}
+
+	// XXX element not added (can't be retrieved)
+	if len(d.Tags) == 0 {
+		SetError(w, ErrNoTags)
+		http.Redirect(w, r, "/user/", http.StatusFound)
+		return
+	}
+
+	if _, err := db.AddDoc(d); err != nil {
+		SetError(w, userError(err))
 		http.Redirect(w, r, "/user/", http.StatusFound)
 		return
 	}
@@ -183,8 +345,8 @@ func edit(w http.ResponseWriter, r *http.Request, uid int32) {
 	i, _ := strconv.ParseInt(r.FormValue("id"), 10, 32)
 	id := int32(i)
 
-	if !db.HasOwner(id, uid) {
-		SetError(w, errors.New("You don't own this."))
+	if err := db.CheckOwner(id, uid); err != nil {
+		SetError(w, userError(err))
 		http.Redirect(w, r, "/user/", http.StatusFound)
 		return
 	}
@@ -196,33 +358,66 @@ func edit(w http.ResponseWriter, r *http.Request, uid int32) {
 		name := r.FormValue("name")
 		tags := splitTags(r.FormValue("tags"))
 		if len(tags) == 0 {
-			return
+			SetError(w, ErrNoTags)
+			break
 		}
 		content := strings.TrimSpace(r.FormValue("content"))
 		typ := getType(content)
-		db.UpdateDoc(&Doc{id, name, typ, content, uid, tags})
+		err := db.UpdateDoc(&Doc{ Id : id, Name : name, Type : typ, Content : content, Uid : uid, Tags : tags })
+		if err != nil {
+			SetError(w, userError(err))
+		}
 	case "delete":
-		db.DelDoc(id)
+		if err := db.DelDoc(id); err != nil {
+			SetError(w, userError(err))
+		} else {
+			SetInfo(w, "Document moved to the trash")
+		}
 	}
 
 	http.Redirect(w, r, "/user/", http.StatusFound)
 }
 
+// subcommands (eg. tags -db sqlite migrate up)
+var commands = map[string]func([]string) error{
+	"migrate":	migrate,
+	"keys":		keys,
+}
+
 var tagsfuncs = map[string]func(http.ResponseWriter, *http.Request, int32){
 	"":       index,
 	"login":  login,
+	"register": register,
 	"logout": logout,
 	"user":   user,
 	"add":    add,
 	"edit":   edit,
-//	"settings"	:	settings,
+	"history": history,
+	"trash":  trash,
+	"tags":   tagPage,
+	"tokens": tokens,
+	"settings": settings,
 }
 
 var mustauth = map[string]bool{
-	"user": true,
-	"add":  true,
-	"edit": true,
-//	"settings"	:	true,
+	"user":   true,
+	"add":    true,
+	"edit":   true,
+	"history": true,
+	"trash":  true,
+	"tags":   true,
+	"tokens": true,
+	"settings": true,
+}
+
+// pages rendered on POST too
+var postpages = map[string]bool{
+	"user":   true,
+	"tokens": true,
+	"settings": true,
+	"history": true,
+	"trash":  true,
+	"tags":   true,
 }
 
 func tags(w http.ResponseWriter, r *http.Request) {
@@ -252,9 +447,22 @@ func tags(w http.ResponseWriter, r *http.Request) {
 		_, uid, _ = getToken(r)
 	}
 
-	if (r.Method == "GET" && f != "logout") || f == "user" {
+	switch {
+	case presession[f] && r.Method == "GET":
+		if err := preCsrf(w, r); err != nil {
+			LogHttp(w, err)
+			return
+		}
+	case (mustauth[f] || presession[f]) && r.Method != "GET" && !checkCsrf(r):
+		http.Error(w, "Invalid or missing CSRF token: "+
+			"reload the page and try again", http.StatusForbidden)
+		return
+	}
+
+	if (r.Method == "GET" && f != "logout") || postpages[f] {
 		writeFiles(w, "templates/header.html")
-		d := struct{ Connected bool }{Connected: uid > 0}
+		_, reg := auth.(Registerer)
+		d := struct{ Connected, Register bool }{uid > 0, reg}
 		if err := ntmpl.Execute(w, &d); err != nil {
 			log.Println(err)
 		}
@@ -262,7 +470,7 @@ func tags(w http.ResponseWriter, r *http.Request) {
 
 	tagsfuncs[f](w, r, uid)
 
-	if (r.Method == "GET" && f != "logout") || f == "user" {
+	if (r.Method == "GET" && f != "logout") || postpages[f] {
 		writeFiles(w, "templates/footer.html")
 	}
 }
@@ -270,35 +478,50 @@ func tags(w http.ResponseWriter, r *http.Request) {
 func main() {
 	var err error
 
-	loginForm, err = ioutil.ReadFile("templates/login.html")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			log.Fatal("unknown command: "+flag.Arg(0))
+		}
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err = loadKeys(*keyfile); err != nil {
+		log.Fatal(err)
+	}
+
+	auth, err = NewAuth(*authname)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// load auth certificate
-	pem, err := ioutil.ReadFile("auth-cert.pem")
+	loginForm, err = template.ParseFiles(auth.Form())
 	if err != nil {
 		log.Fatal(err)
 	}
-	
-	certs := x509.NewCertPool()
-	if !certs.AppendCertsFromPEM(pem) {
-		log.Fatal(errors.New("can't add auth-cert.pem"))
+
+	// Load Database
+	db, err = OpenStore(*backend, *dsn)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// create Client for auth requests
-	Client = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: certs,
-			},
-		},
+	sessions, err = NewSessions(*sessname, db)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Load Database
-	db = NewDB()
+	if *retention > 0 || sessions != nil && *sessionttl > 0 {
+		go expire()
+	}
 
 	http.HandleFunc("/", tags)
+	http.HandleFunc(apiprefix, api)
 
 	// TODO automatically tag :bookmark for type=url
 
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// post form to handler h as user uid
+func post(h func(http.ResponseWriter, *http.Request, int32), uid int32,
+		form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h(w, r, uid)
+	return w
+}
+
+// value of the tags-info cookie set in w, if any
+func infoCookie(w *httptest.ResponseRecorder) string {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "tags-info" {
+			return strings.Replace(c.Value, "_", " ", -1)
+		}
+	}
+	return ""
+}
+
+func TestHandlers(t *testing.T) {
+	db = NewMemStore()
+
+	w := post(add, 1, url.Values{
+		"name"		:	{"Slackware"},
+		"tags"		:	{"bookmarks, linux"},
+		"content"	:	{"http://www.slackware.com/"},
+	})
+	if w.Code != http.StatusFound || infoCookie(w) != "" {
+		t.Fatal("Cannot add document:", infoCookie(w))
+	}
+
+	w = post(add, 1, url.Values{ "name" : {"notags"}, "content" : {"x"} })
+	if !strings.HasPrefix(infoCookie(w), "Error:") {
+		t.Error("Document without tags added")
+	}
+
+	ds := docsOf(t, db, 1, TagExpr("linux"), nil)
+	if len(ds) != 1 || ds[0].Type != "url" {
+		t.Fatal("Wrong documents:", ds)
+	}
+	id := ds[0].Id
+
+	// search from the user page
+	w = post(user, 1, url.Values{ "search" : {"bookmarks"} })
+	if !strings.Contains(w.Body.String(), "slackware.com") {
+		t.Error("Document not displayed")
+	}
+
+	// someone else can't edit it
+	w = post(edit, 2, url.Values{
+		"id"		:	{strconv.Itoa(int(id))},
+		"action"	:	{"delete"},
+	})
+	if !strings.HasPrefix(infoCookie(w), "Error:") || docOf(db, id).Id == -1 {
+		t.Error("Foreign document deleted")
+	}
+
+	w = post(edit, 1, url.Values{
+		"id"		:	{strconv.Itoa(int(id))},
+		"action"	:	{"edit"},
+		"name"		:	{"Slackware Linux"},
+		"tags"		:	{"linux distro"},
+		"content"	:	{"some text"},
+	})
+	if d := docOf(db, id); d.Name != "Slackware Linux" ||
+	   d.Type != "text" || len(d.Tags) != 2 {
+		t.Error("Document not updated:", d)
+	}
+
+	w = post(edit, 1, url.Values{ "id" : {strconv.Itoa(int(id))}, "action" : {"edit"}, "tags" : {""} })
+	if infoCookie(w) != "Error: "+ErrNoTags.Error() || len(docOf(db, id).Tags) != 2 {
+		t.Error("Document without tags saved:", infoCookie(w))
+	}
+
+	post(edit, 1, url.Values{ "id" : {strconv.Itoa(int(id))}, "action" : {"delete"} })
+	if docOf(db, id).Id != -1 {
+		t.Error("Document not deleted")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	for _, test := range []struct {
+		s, ws, res	string
+	}{
+		{ "no match", "gopher", "" },
+		{ "<b>Gopher</b> & co", "gopher", "&lt;b&gt;<mark>Gopher</mark>&lt;/b&gt; &amp; co" },
+		{
+			"one two three four five six seven eight nine ten gopher",
+			"gopher",
+			"…three four five six seven eight nine ten <mark>gopher</mark>",
+		},
+	} {
+		if res := string(snippet(test.s, strings.Fields(test.ws))); res != test.res {
+			t.Error("Bad snippet:", res, test.res)
+		}
+	}
+}
+
+func TestTokensPage(t *testing.T) {
+	db = NewMemStore()
+
+	w := post(tokens, 1, url.Values{
+		"action"	:	{"create"},
+		"name"		:	{"cli"},
+		"scope"		:	{"write"},
+	})
+	ts, _ := db.GetTokens(1)
+	if len(ts) != 1 || !strings.Contains(w.Body.String(), "won't be shown again") {
+		t.Fatal("Token not created:", ts)
+	}
+
+	w = post(tokens, 1, url.Values{ "action" : {"create"}, "name" : {"x"}, "scope" : {"admin"} })
+	if !strings.Contains(w.Body.String(), "Invalid scope: admin") {
+		t.Error("Bad scope accepted")
+	}
+
+	post(tokens, 2, url.Values{ "action" : {"revoke"}, "id" : {strconv.Itoa(int(ts[0].Id))} })
+	post(tokens, 1, url.Values{ "action" : {"revoke"}, "id" : {"42"} })
+	if ts, _ := db.GetTokens(1); len(ts) != 1 {
+		t.Fatal("Token revoked by someone else")
+	}
+
+	post(tokens, 1, url.Values{ "action" : {"revoke"}, "id" : {strconv.Itoa(int(ts[0].Id))} })
+	if ts, _ := db.GetTokens(1); len(ts) != 0 {
+		t.Error("Token not revoked")
+	}
+}
+
+func TestLocalAuth(t *testing.T) {
+	db, auth = NewMemStore(), &LocalAuth{}
+
+	for _, form := range []url.Values{
+		{ "login" : {""}, "password" : {"password"}, "password2" : {"password"} },
+		{ "login" : {"bob"}, "password" : {"short"}, "password2" : {"short"} },
+		{ "login" : {"bob"}, "password" : {"password"}, "password2" : {"passwOrd"} },
+	} {
+		if w := post(register, 0, form); !strings.HasPrefix(infoCookie(w), "Error:") {
+			t.Error("Bad registration accepted:", form)
+		}
+	}
+
+	form := url.Values{ "login" : {"bob"}, "password" : {"password"}, "password2" : {"password"} }
+	if w := post(register, 0, form); infoCookie(w) != "" || w.Header().Get("Location") != "/user/" {
+		t.Fatal("Cannot register:", infoCookie(w))
+	}
+	if w := post(register, 0, form); !strings.HasPrefix(infoCookie(w), "Error:") {
+		t.Error("Name registered twice")
+	}
+
+	w := post(login, 0, url.Values{ "login" : {"bob"}, "password" : {"nope"} })
+	if infoCookie(w) != "Error: "+ErrBadLogin.Error() {
+		t.Error("Logged in with a bad password")
+	}
+
+	w = post(login, 0, url.Values{ "login" : {"bob"}, "password" : {"password"} })
+	if w.Header().Get("Location") != "/user/" {
+		t.Fatal("Cannot log in:", infoCookie(w))
+	}
+
+	// the cookie authenticates further requests
+	r := httptest.NewRequest("GET", "/user/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if uid, err := ChainToken(httptest.NewRecorder(), r); err != nil || uid != 1 {
+		t.Error("Bad cookie:", uid, err)
+	}
+
+	// not after logout, even if kept
+	lr := httptest.NewRequest("GET", "/logout/", nil)
+	for _, c := range w.Result().Cookies() {
+		lr.AddCookie(c)
+	}
+	logout(httptest.NewRecorder(), lr, 0)
+	if _, err := ChainToken(httptest.NewRecorder(), r); err == nil {
+		t.Error("Cookie valid after logout")
+	}
+}
+
+func TestSessionRevoke(t *testing.T) {
+	db, auth = NewMemStore(), &LocalAuth{}
+	sessions = NewMemSessions()
+	defer func() { sessions = nil }()
+
+	form := url.Values{ "login" : {"bob"}, "password" : {"password"}, "password2" : {"password"} }
+
+	// registering logs in; log in again
+	var cookies [2][]*http.Cookie
+	cookies[0] = post(register, 0, form).Result().Cookies()
+	cookies[1] = post(login, 0, form).Result().Cookies()
+	ss, _ := sessions.GetSessions(1)
+	if len(ss) != 2 {
+		t.Fatal("Bad sessions:", ss)
+	}
+
+	req := func(method, path string, i int) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		for _, c := range cookies[i] {
+			r.AddCookie(c)
+		}
+		return r
+	}
+	chain := func(i int) error {
+		_, err := ChainToken(httptest.NewRecorder(), req("GET", "/user/", i))
+		return err
+	}
+
+	if chain(0) != nil || chain(1) != nil {
+		t.Fatal("Sessions not usable")
+	}
+
+	// revoke the second session from the first
+	w := httptest.NewRecorder()
+	r := req("POST", "/settings/", 0)
+	r.Form = url.Values{ "action" : {"revoke"}, "id" : {cookieSid(req("GET", "/", 1))} }
+	settings(w, r, 1)
+	if chain(1) == nil {
+		t.Error("Revoked session still valid")
+	}
+	if chain(0) != nil {
+		t.Error("Current session revoked")
+	}
+
+	// the cookie is useless after logout, even if replayed
+	logout(httptest.NewRecorder(), req("GET", "/logout", 0), 0)
+	if chain(0) == nil {
+		t.Error("Session valid after logout")
+	}
+	if ss, _ := sessions.GetSessions(1); len(ss) != 0 {
+		t.Error("Sessions left:", ss)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	db = NewMemStore()
+
+	for _, form := range []url.Values{
+		{ "action" : {"prefs"}, "pagesize" : {"-1"}, "format" : {"plain"} },
+		{ "action" : {"prefs"}, "pagesize" : {"1"}, "format" : {"html"} },
+		{ "action" : {"prefs"}, "pagesize" : {"1"}, "format" : {"plain"}, "search" : {"(a"} },
+	} {
+		if w := post(settings, 1, form); !strings.Contains(w.Body.String(), "Error:") {
+			t.Error("Bad preferences saved:", form)
+		}
+	}
+
+	w := post(settings, 1, url.Values{
+		"action"	:	{"prefs"},
+		"tags"		:	{"inbox, misc"},
+		"search"	:	{"-archived"},
+		"pagesize"	:	{"1"},
+		"public"	:	{"on"},
+		"format"	:	{"pre"},
+	})
+	p, _ := db.GetPrefs(1)
+	if !strings.Contains(w.Body.String(), "Preferences saved") || len(p.Tags) != 2 ||
+	   p.Search != "-archived" || p.PageSize != 1 || !p.Public || p.Format != "pre" {
+		t.Fatal("Preferences not saved:", p)
+	}
+
+	// default tags and visibility, no tags required
+	post(add, 1, url.Values{ "name" : {"a"}, "tags" : {"misc"}, "content" : {"a"} })
+	post(add, 1, url.Values{ "name" : {"b"}, "content" : {"b"} })
+	post(add, 1, url.Values{ "name" : {"c"}, "tags" : {"archived"}, "content" : {"c"} })
+	ds := docsOf(t, db, 1, nil, nil)
+	if len(ds) != 3 || len(ds[0].Tags) != 3 || !hasTag(&ds[1], ":public") {
+		t.Fatal("Preferences not applied:", ds)
+	}
+
+	// default search, page size, formatter
+	r := httptest.NewRequest("GET", "/user/", nil)
+	w = httptest.NewRecorder()
+	user(w, r, 1)
+	body := w.Body.String()
+	if strings.Count(body, `name="id"`) != 1 || !strings.Contains(body, "Next page") ||
+	   !strings.Contains(body, "format-pre") || !strings.Contains(body, `value="-archived"`) {
+		t.Error("Bad user page:", body)
+	}
+
+	// an explicit empty search overrides the default
+	w = post(user, 1, url.Values{ "search" : {""} })
+	if strings.Contains(w.Body.String(), `value="-archived"`) {
+		t.Error("Default search not overridden")
+	}
+}
+
+func TestTrashPage(t *testing.T) {
+	db = NewMemStore()
+
+	var ids []string
+	for _, n := range []string{ "a", "b", "c" } {
+		id := mustAdd(t, db, &Doc{ Id : -1, Name : n, Type : "text", Content : n, Uid : 1, Tags : []string{"x"} })
+		ids = append(ids, strconv.Itoa(int(id)))
+		if w := post(edit, 1, url.Values{ "id" : {ids[len(ids)-1]}, "action" : {"delete"} });
+		   infoCookie(w) != "Document moved to the trash" {
+			t.Fatal("Document not deleted:", infoCookie(w))
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/trash/", nil)
+	w := httptest.NewRecorder()
+	trash(w, r, 1)
+	if body := w.Body.String(); strings.Count(body, `name="id"`) != 3 || !strings.Contains(body, "30 days") {
+		t.Fatal("Bad trash page:", body)
+	}
+
+	post(trash, 2, url.Values{ "action" : {"restore"}, "id" : {ids[0]} })
+	if w := post(trash, 1, url.Values{ "action" : {"restore"}, "id" : {ids[0]} }); len(docsOf(t, db, 1, nil, nil)) != 1 {
+		t.Error("Document not restored:", w.Body.String())
+	}
+
+	post(trash, 1, url.Values{ "action" : {"purge"}, "id" : {ids[1]} })
+	if ts, _ := db.GetTrash(1); len(ts) != 1 {
+		t.Error("Document not purged:", ts)
+	}
+
+	post(trash, 1, url.Values{ "action" : {"empty"} })
+	if ts, _ := db.GetTrash(1); len(ts) != 0 || len(docsOf(t, db, 1, nil, nil)) != 1 {
+		t.Error("Trash not emptied:", ts)
+	}
+}
+
+func TestTagPage(t *testing.T) {
+	db = NewMemStore()
+	for _, tags := range [][]string{ {"go", "golang"}, {"golang", "c"} } {
+		mustAdd(t, db, &Doc{ Id : -1, Name : "x", Type : "text", Content : "x", Uid : 1, Tags : tags })
+	}
+
+	w := post(tagPage, 1, url.Values{ "action" : {"rename"}, "from" : {"c"}, "to" : {"two words"} })
+	if !strings.Contains(w.Body.String(), ErrBadTag.Error()) {
+		t.Error("Bad rename accepted")
+	}
+
+	post(tagPage, 1, url.Values{ "action" : {"rename"}, "from" : {"c"}, "to" : {"clang"} })
+	post(tagPage, 1, url.Values{ "action" : {"merge"}, "from" : {"go", "golang"}, "to" : {"go"} })
+	post(tagPage, 2, url.Values{ "action" : {"delete"}, "from" : {"go"} })
+	if ts := tagsOf(t, db, 1); len(ts) != 2 || ts[0].Name != "clang" || ts[1].Name != "go" || ts[1].Count != 2 {
+		t.Fatal("Bad tags:", ts)
+	}
+
+	w = post(tagPage, 1, url.Values{ "action" : {"delete"}, "from" : {"go"} })
+	if ts := tagsOf(t, db, 1); len(ts) != 1 || !strings.Contains(w.Body.String(), "Tag deleted") {
+		t.Error("Tag not deleted:", ts)
+	}
+
+	// subtrees move along
+	post(tagPage, 1, url.Values{ "action" : {"rename"}, "from" : {"clang"}, "to" : {"lang/c"} })
+	w = post(tagPage, 1, url.Values{ "action" : {"rename"}, "from" : {"lang"}, "to" : {"languages"} })
+	if ts := tagsOf(t, db, 1); len(ts) != 1 || ts[0].Name != "languages/c" ||
+	   !strings.Contains(w.Body.String(), `search=%22languages%22`) {
+		t.Error("Subtree not moved:", ts)
+	}
+}
+
+func TestTagTreeNodes(t *testing.T) {
+	var s []string
+	for _, n := range tagTree([]Tag{
+		{ ":public", 1 },
+		{ "science/maths", 2 },
+		{ "science/physics/quantum", 1 },
+		{ "science", 1 },
+		{ "science-fiction", 3 },
+		{ "/r/", 2 },
+		{ "/r/golang/", 1 },
+	}) {
+		s = append(s, strings.Repeat(" ", n.Depth)+n.Base+":"+
+			strconv.Itoa(n.Count)+"/"+strconv.Itoa(n.Total))
+	}
+
+	if r := strings.Join(s, ","); r != "r:0/1, golang:1/1,r:2/2,:public:1/1,science:1/4, maths:2/2, physics:0/1,  quantum:1/1,science-fiction:3/3" {
+		t.Error("Bad tree:", r)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+// Personal API tokens: long-lived, revocable, sent as
+//	Authorization: Bearer <token>
+// to the JSON API. Only their SHA-256 is stored.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ttmpl = template.Must(
+	template.New("tokens.html").ParseFiles("templates/tokens.html"))
+
+// newToken generates a token; returns it with its hash.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// bearer authenticates r with its Authorization header, if any.
+func bearer(r *http.Request) (t Token, ok bool, err error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return t, false, nil
+	}
+	if !strings.HasPrefix(h, "Bearer ") {
+		return t, true, errors.New("Bad authorization")
+	}
+
+	t, err = db.GetToken(hashToken(strings.TrimPrefix(h, "Bearer ")))
+	if err != nil {
+		err = errors.New("Invalid token")
+	}
+
+	return t, true, err
+}
+
+// list, create and revoke one's tokens
+func tokens(w http.ResponseWriter, r *http.Request, uid int32) {
+	var err error
+
+	d := struct {
+		Tokens	[]Token
+		New		string	// token just created, shown once
+		Error	error
+		Csrf	string
+	}{ Csrf : csrfToken(r) }
+
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			var hash string
+			t := &Token{ Uid : uid, Name : r.FormValue("name"), Scope : r.FormValue("scope") }
+			if t.Scope != "read" && t.Scope != "write" {
+				d.Error = errors.New("Invalid scope: "+t.Scope)
+				break
+			}
+			if d.New, hash, err = newToken(); err == nil {
+				_, err = db.AddToken(t, hash)
+			}
+			if err != nil {
+				d.New, d.Error = "", userError(err)
+			}
+		case "revoke":
+			i, _ := strconv.ParseInt(r.FormValue("id"), 10, 32)
+			if err = db.DelToken(int32(i), uid); err != nil {
+				d.Error = userError(err)
+			}
+		}
+	}
+
+	if d.Tokens, err = db.GetTokens(uid); err != nil {
+		d.Error = userError(err)
+	}
+
+	if err := ttmpl.Execute(w, &d); err != nil {
+		LogHttp(w, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// Trash: deleted documents are kept until purged, by hand or
+// automatically after the retention period (-retention).
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var trtmpl = template.Must(
+	template.New("trash.html").Funcs(template.FuncMap{
+		"GetTags": func(tags []string) string {
+			return strings.Join(tags, ", ")
+		},
+	}).ParseFiles("templates/trash.html"))
+
+// expire purges documents trashed for longer than
+// the retention period, and sessions unused for longer
+// than -sessionttl, hourly.
+func expire() {
+	for {
+		if *retention > 0 {
+			if n, err := db.Expire(time.Now().Add(-*retention)); err != nil {
+				LogError(err)
+			} else if n > 0 {
+				log.Printf("purged %d expired documents", n)
+			}
+		}
+		if sessions != nil && *sessionttl > 0 {
+			if n, err := sessions.ExpireSessions(time.Now().Add(-*sessionttl)); err != nil {
+				LogError(err)
+			} else if n > 0 {
+				log.Printf("expired %d sessions", n)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// human readable retention period
+func retentionString() string {
+	switch {
+	case *retention <= 0:
+		return ""
+	case *retention%(24*time.Hour) == 0:
+		return fmt.Sprintf("%d days", *retention/(24*time.Hour))
+	}
+	return retention.String()
+}
+
+// list, restore and purge one's trashed documents
+func trash(w http.ResponseWriter, r *http.Request, uid int32) {
+	var err error
+
+	if r.Method == "POST" {
+		i, _ := strconv.ParseInt(r.FormValue("id"), 10, 32)
+		switch r.FormValue("action") {
+		case "restore":
+			err = db.RestoreDoc(int32(i), uid)
+		case "purge":
+			err = db.PurgeDoc(int32(i), uid)
+		case "empty":
+			var ts []Trashed
+			ts, err = db.GetTrash(uid)
+			for _, t := range ts {
+				if err == nil {
+					err = db.PurgeDoc(t.Id, uid)
+				}
+			}
+		}
+		if err != nil {
+			err = errors.New("Cannot "+r.FormValue("action")+": "+userError(err).Error())
+		}
+	}
+
+	d := struct {
+		Docs		[]Trashed
+		Retention	string
+		Error		error
+		Csrf		string
+	}{ Retention : retentionString(), Error : err, Csrf : csrfToken(r) }
+
+	if d.Docs, err = db.GetTrash(uid); err != nil {
+		d.Error = userError(err)
+	}
+
+	if err := trtmpl.Execute(w, &d); err != nil {
+		LogHttp(w, err)
+	}
+}